@@ -44,19 +44,57 @@ type MessageConsumer interface {
 	Consume(Message)
 }
 
-// RoundRobinDispatcher is an interface representing entity capable
-// of dispatching messages to set of MessageConsumers in a round-robin fashion.
-type RoundRobinDispatcher interface {
+// MessageDispatcher is an interface representing entity capable
+// of dispatching messages to set of MessageConsumers, using some Dispatcher
+// strategy.
+type MessageDispatcher interface {
 	Subscribe(MessageConsumer) error
 	Unsubscribe(MessageConsumer) error
 	Subscriptions() []MessageConsumer
 }
 
+// RoundRobinDispatcher is an interface representing entity capable
+// of dispatching messages to set of MessageConsumers in a round-robin fashion.
+//
+// Deprecated: dispatch strategy is pluggable, use MessageDispatcher.
+type RoundRobinDispatcher = MessageDispatcher
+
+// Dispatcher is an interface representing strategy used by MessageDispatcher
+// to choose consumer for next message, implementors does not need to worry
+// about concurrent access.
+//
+// Next() returns one of consumers eligible according to DispatchState,
+// or nil if there are none.
+type Dispatcher interface {
+	Add(MessageConsumer) error
+	Remove(MessageConsumer) error
+	Next(DispatchState) MessageConsumer
+	Len() int
+}
+
+// DispatchState is an interface giving Dispatcher insight into state
+// of consumers.
+type DispatchState interface {
+	// Eligible reports whatever consumer can receive next message.
+	Eligible(MessageConsumer) bool
+
+	// Outstanding returns number of deliveries passed to consumer, which are
+	// not consumed or not settled yet.
+	Outstanding(MessageConsumer) int
+
+	// Weight returns positive relative weight of consumer.
+	Weight(MessageConsumer) int
+}
+
 // Binding is an type representing connection between Message Exchange and
 // either another Message Exchange or Message Queue.
+//
+// Arguments are optional binding arguments, interpreted by Matcher
+// implementation (like x-match for headers exchange).
 type Binding struct {
-	Key      string
-	Consumer MessageConsumer
+	Key       string
+	Arguments Headers
+	Consumer  MessageConsumer
 }
 
 // MessagePublisher is an interface representing entity capable of directing
@@ -71,3 +109,43 @@ type MessagePublisher interface {
 type Matcher interface {
 	Matches(Message, *Binding) bool
 }
+
+// SelectingMatcher is an interface implemented by Matchers witch route every
+// message to exactly one binding, instead of deciding per binding.
+//
+// Exchange calls NewSelector() once and keeps returned BindingSelector in sync
+// with its bindings, Matches() is not used by such Exchange.
+type SelectingMatcher interface {
+	Matcher
+	NewSelector() BindingSelector
+}
+
+// BindingSelector is an interface representing stateful strategy selecting
+// single binding for message, implementors does not need to worry about
+// concurrent access.
+type BindingSelector interface {
+	Add(*Binding) error
+	Remove(*Binding)
+	Select(Message) *Binding
+}
+
+// IndexingMatcher is an interface implemented by Matchers able to build
+// routing index of bindings, so Exchange does not need to call Matches() for
+// every binding.
+//
+// Exchange calls NewIndex() once and keeps returned BindingIndex in sync with
+// its bindings.
+type IndexingMatcher interface {
+	Matcher
+	NewIndex() BindingIndex
+}
+
+// BindingIndex is an interface representing routing index of bindings,
+// Match() MUST return each matching binding only once. Implementors does not
+// need to worry about concurrent access, but Match() may be called from
+// multiple goroutines at once.
+type BindingIndex interface {
+	Add(*Binding) error
+	Remove(*Binding)
+	Match(Message) []*Binding
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrBrowseNotSupported = errors.New("Queue: Handler does not support browsing")
+)
+
+// IterableQueueHandler is an interface implemented by QueueHandlers capable
+// of iterating over held messages without removing them, Queue needs it
+// for Browse().
+//
+// Iterate() calls fn for every held message in delivery order, until fn
+// returns false.
+type IterableQueueHandler interface {
+	QueueHandler
+	Iterate(fn func(Message) bool)
+}
+
+// BrowseFilter reports whatever message held in Queue at given time should be
+// included in Browse() result, nil filter matches every message.
+type BrowseFilter func(msg Message, now time.Time) bool
+
+// AllOf returns BrowseFilter matching messages matched by all given filters.
+func AllOf(filters ...BrowseFilter) BrowseFilter {
+	return func(msg Message, now time.Time) bool {
+		for _, filter := range filters {
+			if filter != nil && !filter(msg, now) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// HeadersFilter returns BrowseFilter matching messages with headers
+// satisfying given predicate.
+func HeadersFilter(predicate func(Headers) bool) BrowseFilter {
+	return func(msg Message, now time.Time) bool {
+		return predicate(msg.Headers())
+	}
+}
+
+// RoutingKeyFilter returns BrowseFilter matching messages with routing key
+// satisfying given predicate.
+func RoutingKeyFilter(predicate func(string) bool) BrowseFilter {
+	return func(msg Message, now time.Time) bool {
+		return predicate(msg.RoutingKey())
+	}
+}
+
+// AgeFilter returns BrowseFilter matching messages with age, measured from
+// their timestamp, in [min, max] range, zero max means no upper bound.
+func AgeFilter(min, max time.Duration) BrowseFilter {
+	return func(msg Message, now time.Time) bool {
+		age := now.Sub(msg.Timestamp())
+		return age >= min && (max == 0 || age <= max)
+	}
+}
+
+// PriorityFilter returns BrowseFilter matching messages with priority
+// in [min, max] range.
+func PriorityFilter(min, max uint8) BrowseFilter {
+	return func(msg Message, now time.Time) bool {
+		priority := msg.Priority()
+		return priority >= min && priority <= max
+	}
+}
+
+// Browse returns snapshot of up to limit messages held in Queue, matching given
+// filter, without removing them, zero or negative limit means no limit.
+// Messages are returned in delivery order, expired messages are skipped.
+// It's safe to call this method from multiple goroutines.
+//
+// Queue handler has to implement IterableQueueHandler, otherwise the returned
+// error will be of type: ErrBrowseNotSupported, if Queue is closed the returned
+// error will be of type: ErrQueueClosed
+func (self *Queue) Browse(filter BrowseFilter, limit int) ([]Message, error) {
+	if _, ok := self.handler.(IterableQueueHandler); !ok {
+		return nil, ErrBrowseNotSupported
+	}
+
+	op := &browseOp{
+		filter: filter,
+		limit:  limit,
+		result: make(chan []Message, 1),
+	}
+
+	select {
+	case self.browse <- op:
+		return <-op.result, nil
+
+	case <-self.closing:
+		return nil, ErrQueueClosed
+	}
+}
+
+// browseAll collects messages matching browse operation, it must be called
+// only by inputHandler.
+func (self *Queue) browseAll(op *browseOp, now time.Time) []Message {
+	var msgs []Message
+
+	self.handler.(IterableQueueHandler).Iterate(func(msg Message) bool {
+		if Expired(msg, now) {
+			return true
+		}
+
+		msg = unwrapHeld(msg)
+		if op.filter == nil || op.filter(msg, now) {
+			msgs = append(msgs, msg)
+		}
+
+		return op.limit <= 0 || len(msgs) < op.limit
+	})
+
+	return msgs
+}
+
+type browseOp struct {
+	filter BrowseFilter
+	limit  int
+	result chan []Message
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"sort"
+)
+
+// ConsumerPriority sets priority of consumer, like x-priority consumer
+// argument, default priority is 0.
+//
+// Queue delivers messages only to consumers with the highest priority which
+// have capacity, consumers with lower priority receive messages only when
+// all consumers with higher priority are saturated.
+func ConsumerPriority(priority int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.priority = priority
+	}
+}
+
+// consumerPriorities groups consumers by priority, consumers with the same
+// priority are chosen by their own Dispatcher.
+type consumerPriorities struct {
+	newDispatcher func() Dispatcher
+
+	// levels are sorted by descending priority
+	levels    []*priorityLevel
+	consumers map[MessageConsumer]int
+
+	// order holds consumers in subscription order
+	order []MessageConsumer
+}
+
+type priorityLevel struct {
+	priority   int
+	dispatcher Dispatcher
+}
+
+func newConsumerPriorities(newDispatcher func() Dispatcher) *consumerPriorities {
+	return &consumerPriorities{
+		newDispatcher: newDispatcher,
+		consumers:     make(map[MessageConsumer]int),
+	}
+}
+
+func (self *consumerPriorities) Len() int {
+	return len(self.consumers)
+}
+
+func (self *consumerPriorities) Add(consumer MessageConsumer, priority int) error {
+	if _, found := self.consumers[consumer]; found {
+		return ErrConsumerAlreadySubscribed
+	}
+
+	i := sort.Search(len(self.levels), func(i int) bool {
+		return self.levels[i].priority <= priority
+	})
+
+	if i == len(self.levels) || self.levels[i].priority != priority {
+		self.levels = append(self.levels, nil)
+		copy(self.levels[i+1:], self.levels[i:])
+		self.levels[i] = &priorityLevel{
+			priority:   priority,
+			dispatcher: self.newDispatcher(),
+		}
+	}
+
+	if err := self.levels[i].dispatcher.Add(consumer); err != nil {
+		return err
+	}
+	self.consumers[consumer] = priority
+	self.order = append(self.order, consumer)
+	return nil
+}
+
+func (self *consumerPriorities) Remove(consumer MessageConsumer) error {
+	priority, found := self.consumers[consumer]
+	if !found {
+		return ErrConsumerNotFound
+	}
+
+	for i, level := range self.levels {
+		if level.priority != priority {
+			continue
+		}
+
+		level.dispatcher.Remove(consumer)
+		if level.dispatcher.Len() == 0 {
+			self.levels = append(self.levels[:i], self.levels[i+1:]...)
+		}
+		break
+	}
+
+	for i, c := range self.order {
+		if c == consumer {
+			self.order = append(self.order[:i], self.order[i+1:]...)
+			break
+		}
+	}
+
+	delete(self.consumers, consumer)
+	return nil
+}
+
+// First returns the earliest subscribed consumer, regardless of its priority.
+//
+// This method panics if there are no consumers.
+func (self *consumerPriorities) First() MessageConsumer {
+	return self.order[0]
+}
+
+// Next returns consumer chosen by Dispatcher of the highest priority level
+// having eligible one, or nil if no consumer is eligible.
+func (self *consumerPriorities) Next(state DispatchState) MessageConsumer {
+	for _, level := range self.levels {
+		if consumer := level.dispatcher.Next(state); consumer != nil {
+			return consumer
+		}
+	}
+
+	return nil
+}
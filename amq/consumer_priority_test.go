@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"testing"
+)
+
+func TestConsumerPriorities_CantAddSameConsumerMultipleTimes(t *testing.T) {
+	cp := newConsumerPriorities(NewRoundRobinDispatcher)
+	c := make(testConsumer)
+
+	if err := cp.Add(c, 1); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := cp.Add(c, 2); err != ErrConsumerAlreadySubscribed {
+		t.Error("Expected ErrConsumerAlreadySubscribed not returned")
+	}
+
+	if err := cp.Remove(c); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := cp.Remove(c); err != ErrConsumerNotFound {
+		t.Error("Expected ErrConsumerNotFound not returned")
+	}
+}
+
+func TestConsumerPriorities_PrefersHigherPriority(t *testing.T) {
+	cp := newConsumerPriorities(NewRoundRobinDispatcher)
+
+	low, mid1, mid2, high := make(testConsumer), make(testConsumer), make(testConsumer), make(testConsumer)
+	cp.Add(low, -1)
+	cp.Add(mid1, 5)
+	cp.Add(high, 10)
+	cp.Add(mid2, 5)
+
+	all := eligibleFunc(func(MessageConsumer) bool { return true })
+	if c := cp.Next(all); c != high {
+		t.Error("Unexpected consumer returned")
+	}
+
+	notHigh := eligibleFunc(func(c MessageConsumer) bool { return c != high })
+	for i, expected := range []MessageConsumer{mid1, mid2, mid1, mid2} {
+		if c := cp.Next(notHigh); c != expected {
+			t.Errorf("Unexpected consumer returned in step %d", i)
+		}
+	}
+
+	onlyLow := eligibleFunc(func(c MessageConsumer) bool { return c == low })
+	if c := cp.Next(onlyLow); c != low {
+		t.Error("Unexpected consumer returned")
+	}
+
+	none := eligibleFunc(func(MessageConsumer) bool { return false })
+	if c := cp.Next(none); c != nil {
+		t.Error("Unexpected consumer returned")
+	}
+
+	cp.Remove(high)
+	if c := cp.Next(all); c != mid1 {
+		t.Error("Unexpected consumer returned")
+	}
+
+	if cp.Len() != 3 {
+		t.Errorf("Unexpected length %d, expected %d", cp.Len(), 3)
+	}
+}
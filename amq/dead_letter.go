@@ -0,0 +1,153 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"time"
+)
+
+// Dead-letter reasons recorded in x-death header.
+const (
+	DeadLetterRejected = "rejected"
+	DeadLetterExpired  = "expired"
+	DeadLetterMaxLen   = "maxlen"
+)
+
+// DeadLetterExchange sets consumer (typically *Exchange) to which Queue
+// republishes messages that are rejected without requeue, expire or overflow
+// Queue limits. When routingKey is not empty it replaces original message
+// routing key.
+//
+// Every dead-lettered message gets x-death header, an array of Headers with
+// reason, queue, count, time and routing-keys fields, the most recent death
+// first. Deaths with the same queue and reason are accumulated in a single
+// entry. Messages are republished from a dedicated goroutine, so it's safe
+// to dead-letter back to the same Queue.
+func DeadLetterExchange(consumer MessageConsumer, routingKey string) QueueOption {
+	return func(q *Queue) {
+		q.dlx = consumer
+		q.dlxRoutingKey = routingKey
+	}
+}
+
+type deadLetter struct {
+	msg    Message
+	reason string
+	time   time.Time
+}
+
+// deadLetter schedules messages for republishing to dead-letter exchange.
+func (self *Queue) deadLetter(reason string, msgs ...Message) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.deadLetterLocked(reason, msgs...)
+}
+
+// deadLetterLocked is deadLetter() variant, which requires self.mu to be held.
+func (self *Queue) deadLetterLocked(reason string, msgs ...Message) {
+	if self.dlx == nil || len(msgs) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, msg := range msgs {
+		self.deadLetters = append(self.deadLetters, deadLetter{
+			msg:    unwrapHeld(msg),
+			reason: reason,
+			time:   now,
+		})
+	}
+
+	select {
+	case self.deadLettered <- struct{}{}:
+	default:
+	}
+}
+
+func (self *Queue) deadLetterHandler() {
+	for {
+		select {
+		case <-self.deadLettered:
+			self.publishDeadLetters()
+
+		case <-self.done:
+			self.publishDeadLetters()
+			self.quitCnf <- true
+			return
+		}
+	}
+}
+
+func (self *Queue) publishDeadLetters() {
+	self.mu.Lock()
+	letters := self.deadLetters
+	self.deadLetters = nil
+	self.mu.Unlock()
+
+	for _, letter := range letters {
+		self.dlx.Consume(self.deadLetterMessage(letter))
+	}
+}
+
+// deadLetterMessage returns copy of message with x-death header updated.
+func (self *Queue) deadLetterMessage(letter deadLetter) Message {
+	msg := letter.msg
+	props := PropertiesOf(msg)
+
+	death := Headers{
+		"reason":       letter.reason,
+		"queue":        self.name,
+		"count":        int64(1),
+		"time":         letter.time,
+		"routing-keys": []interface{}{msg.RoutingKey()},
+	}
+
+	// Message must not expire again in dead-letter queue
+	if props.Expiration != "" {
+		death["original-expiration"] = props.Expiration
+		props.Expiration = ""
+	}
+
+	deaths := []interface{}{death}
+	if previous, ok := msg.Headers()["x-death"].([]interface{}); ok {
+		for _, entry := range previous {
+			if h, ok := entry.(Headers); ok && h["queue"] == self.name && h["reason"] == letter.reason {
+				count, _ := h["count"].(int64)
+				death["count"] = count + 1
+			} else {
+				deaths = append(deaths, entry)
+			}
+		}
+	}
+
+	builder := MessageBuilderFrom(msg).
+		Properties(props).
+		Header("x-death", deaths)
+
+	if _, found := msg.Headers()["x-first-death-reason"]; !found {
+		builder.
+			Header("x-first-death-reason", letter.reason).
+			Header("x-first-death-queue", self.name)
+	}
+
+	if self.dlxRoutingKey != "" {
+		builder.RoutingKey(self.dlxRoutingKey)
+	}
+
+	return builder.Build()
+}
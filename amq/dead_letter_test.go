@@ -0,0 +1,171 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+	"github.com/canni/paperboymq/queue"
+)
+
+func TestDeadLetter_RejectedMessageIsDeadLettered(t *testing.T) {
+	dlx := make(messageConsumer, 1)
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.QueueName("jobs"),
+		amq.DeadLetterExchange(dlx, ""),
+	)
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{routingKey: "key"})
+
+	c.next(t).Reject(false)
+
+	msg := dlx.next(t)
+	if msg.RoutingKey() != "key" {
+		t.Error("Unexpected routing key:", msg.RoutingKey())
+	}
+
+	death := xDeath(t, msg, 0)
+	if death["reason"] != amq.DeadLetterRejected || death["queue"] != "jobs" || death["count"] != int64(1) {
+		t.Error("Unexpected x-death entry:", death)
+	}
+	if _, ok := death["time"].(time.Time); !ok {
+		t.Error("Unexpected x-death time:", death["time"])
+	}
+	if msg.Headers()["x-first-death-reason"] != amq.DeadLetterRejected {
+		t.Error("Unexpected x-first-death-reason:", msg.Headers()["x-first-death-reason"])
+	}
+}
+
+func TestDeadLetter_RequeuedMessageIsNotDeadLettered(t *testing.T) {
+	dlx := make(messageConsumer, 1)
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.DeadLetterExchange(dlx, ""))
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{})
+
+	c.next(t).Nack(false, true)
+	c.next(t)
+	dlx.none(t)
+}
+
+func TestDeadLetter_ExpiredMessageIsDeadLetteredWithRoutingKeyOverride(t *testing.T) {
+	dlx := make(messageConsumer, 1)
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.QueueName("jobs"),
+		amq.DeadLetterExchange(dlx, "dead"),
+	)
+	defer q.Close()
+
+	q.Consume(amq.NewMessageBuilder().RoutingKey("key").Expiration("5").Build())
+
+	msg := dlx.next(t)
+	if msg.RoutingKey() != "dead" {
+		t.Error("Unexpected routing key:", msg.RoutingKey())
+	}
+	if amq.PropertiesOf(msg).Expiration != "" {
+		t.Error("Expiration property was not removed")
+	}
+
+	death := xDeath(t, msg, 0)
+	if death["reason"] != amq.DeadLetterExpired || death["original-expiration"] != "5" {
+		t.Error("Unexpected x-death entry:", death)
+	}
+	if keys := death["routing-keys"].([]interface{}); len(keys) != 1 || keys[0] != "key" {
+		t.Error("Unexpected x-death routing keys:", keys)
+	}
+}
+
+func TestDeadLetter_DeathsAreAccumulated(t *testing.T) {
+	c := make(deliveryConsumer, 1)
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.QueueName("jobs"))
+	defer q.Close()
+
+	// Rejected retries are dead-lettered back to jobs queue
+	retry := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.QueueName("retry"),
+		amq.DeadLetterExchange(q, ""),
+	)
+	defer retry.Close()
+
+	q.SubscribeWith(c, amq.ManualAck())
+	retry.SubscribeWith(c, amq.ManualAck())
+
+	retry.Consume(testMsg{})
+	c.next(t).Reject(false)
+
+	d := c.next(t)
+	if death := xDeath(t, d, 0); death["count"] != int64(1) {
+		t.Error("Unexpected x-death entry:", death)
+	}
+
+	d.Ack(false)
+	retry.Consume(d)
+	c.next(t).Reject(false)
+
+	msg := c.next(t)
+	deaths := msg.Headers()["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Error("Unexpected x-death entries:", deaths)
+	}
+	if death := xDeath(t, msg, 0); death["count"] != int64(2) || death["queue"] != "retry" {
+		t.Error("Unexpected x-death entry:", death)
+	}
+}
+
+func xDeath(t *testing.T, msg amq.Message, i int) amq.Headers {
+	deaths, ok := msg.Headers()["x-death"].([]interface{})
+	if !ok || len(deaths) <= i {
+		t.Fatal("Missing x-death header")
+	}
+
+	return deaths[i].(amq.Headers)
+}
+
+type messageConsumer chan amq.Message
+
+func (self messageConsumer) Consume(msg amq.Message) {
+	self <- msg
+}
+
+func (self messageConsumer) next(t *testing.T) amq.Message {
+	select {
+	case msg := <-self:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("Expected message not received")
+	}
+
+	return nil
+}
+
+func (self messageConsumer) none(t *testing.T) {
+	select {
+	case <-self:
+		t.Error("Unexpected message received")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
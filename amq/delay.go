@@ -0,0 +1,154 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"time"
+)
+
+// DelayedMessage is an interface implemented by messages which should not be
+// delivered before given time, zero time means message is not delayed.
+type DelayedMessage interface {
+	NotBefore() time.Time
+}
+
+// ScheduledQueueHandler is an interface implemented by QueueHandlers capable
+// of holding delayed messages until they're due, see NotBefore(). Scheduled
+// messages are invisible to Peek(), Remove() and Len() calls, and they don't
+// count towards Queue length limits until they're due.
+//
+// Queue calls Advance() with current time before every operation, handler
+// makes messages due at that time visible and returns them, along with
+// channel signaled when next scheduled message is due, or nil channel if
+// there is none.
+type ScheduledQueueHandler interface {
+	QueueHandler
+	Advance(now time.Time) ([]Message, <-chan time.Time)
+}
+
+// NotBefore returns time before which message arrived at given time should
+// not be delivered, zero time means message is not delayed.
+//
+// Messages implementing DelayedMessage interface report the time themselves,
+// like messages already held by Queue, otherwise it's taken from x-not-before
+// header (time.Time value), or from x-delay header (integer number
+// of milliseconds) counted from arrival time.
+func NotBefore(msg Message, arrived time.Time) time.Time {
+	for {
+		if d, ok := msg.(DelayedMessage); ok {
+			return d.NotBefore()
+		}
+
+		if w, ok := msg.(messageWrapper); ok {
+			msg = w.unwrap()
+		} else {
+			break
+		}
+	}
+
+	headers := msg.Headers()
+	if notBefore, ok := headers["x-not-before"].(time.Time); ok {
+		return notBefore
+	}
+
+	if delay, ok := delayMillis(headers["x-delay"]); ok && delay > 0 {
+		return arrived.Add(time.Duration(delay) * time.Millisecond)
+	}
+
+	return time.Time{}
+}
+
+// Delayed reports whatever message arriving at given time should not be
+// delivered yet.
+func Delayed(msg Message, now time.Time) bool {
+	return NotBefore(msg, now).After(now)
+}
+
+// dueMessage wraps message routed by Exchange once it's due, so it's not
+// delayed again by x-delay header.
+type dueMessage struct {
+	Message
+	notBefore time.Time
+}
+
+func (self *dueMessage) NotBefore() time.Time {
+	return self.notBefore
+}
+
+func (self *dueMessage) unwrap() Message {
+	return self.Message
+}
+
+func unwrapDue(msg Message) Message {
+	if d, ok := msg.(*dueMessage); ok {
+		return d.Message
+	}
+
+	return msg
+}
+
+func delayMillis(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	case float32:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+
+	return 0, false
+}
+
+// advanceScheduled makes due messages visible, when handler supports
+// scheduling, and returns channel signaled when next message is due.
+//
+// Due messages were already accepted, so they are never rejected, but they
+// may push out messages from the head of queue with OverflowDropHead policy.
+func (self *Queue) advanceScheduled(now time.Time) <-chan time.Time {
+	scheduled, ok := self.handler.(ScheduledQueueHandler)
+	if !ok {
+		return nil
+	}
+
+	due, next := scheduled.Advance(now)
+	for _, msg := range due {
+		self.bytes += len(msg.Body())
+	}
+
+	if len(due) > 0 && self.overflow == OverflowDropHead {
+		self.dropOverLimits()
+	}
+
+	return next
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+	"github.com/canni/paperboymq/matcher"
+	"github.com/canni/paperboymq/queue"
+)
+
+func TestNotBefore(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		msg       amq.Message
+		notBefore time.Time
+	}{
+		{testMsg{}, time.Time{}},
+		{testMsg{headers: amq.Headers{"x-not-before": now}}, now},
+		{testMsg{headers: amq.Headers{"x-delay": 1500}}, now.Add(1500 * time.Millisecond)},
+		{testMsg{headers: amq.Headers{"x-delay": int64(10)}}, now.Add(10 * time.Millisecond)},
+		{testMsg{headers: amq.Headers{"x-delay": float64(10)}}, now.Add(10 * time.Millisecond)},
+		{testMsg{headers: amq.Headers{"x-delay": -10}}, time.Time{}},
+		{testMsg{headers: amq.Headers{"x-delay": "10"}}, time.Time{}},
+		{testMsg{headers: amq.Headers{"x-delay": 10}, timestamp: now.Add(-time.Hour)}, now.Add(10 * time.Millisecond)},
+	}
+
+	for i, testCase := range cases {
+		if notBefore := amq.NotBefore(testCase.msg, now); !notBefore.Equal(testCase.notBefore) {
+			t.Errorf("case: %d; Unexpected not-before time %v, expected %v", i+1, notBefore, testCase.notBefore)
+		}
+	}
+}
+
+func TestDelay_QueueHoldsDelayedMessagesUntilDue(t *testing.T) {
+	q := amq.NewQueue(queue.NewScheduledHandler(queue.NewQueueHandler()))
+	defer q.Close()
+
+	published := time.Now()
+	q.Consume(testMsg{
+		routingKey: "delayed",
+		headers:    amq.Headers{"x-delay": 50},
+		timestamp:  published.Add(-time.Hour),
+	})
+	q.Consume(testMsg{routingKey: "immediate"})
+
+	if q.Len() != 1 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 1)
+	}
+
+	c := make(messageConsumer, 2)
+	q.Subscribe(c)
+
+	if msg := c.next(t); msg.RoutingKey() != "immediate" {
+		t.Error("Unexpected message received:", msg.RoutingKey())
+	}
+	c.none(t)
+
+	if msg := c.next(t); msg.RoutingKey() != "delayed" {
+		t.Error("Unexpected message received:", msg.RoutingKey())
+	}
+
+	if elapsed := time.Since(published); elapsed < 50*time.Millisecond {
+		t.Error("Delayed message received too early:", elapsed)
+	}
+}
+
+func TestDelay_RequeuedMessagesAreNotDelayedAgain(t *testing.T) {
+	q := amq.NewQueue(queue.NewScheduledHandler(queue.NewQueueHandler()))
+	defer q.Close()
+
+	q.Consume(testMsg{headers: amq.Headers{"x-delay": 50}})
+
+	c := make(deliveryConsumer, 2)
+	q.SubscribeWith(c, amq.ManualAck())
+
+	c.next(t).Reject(true)
+
+	requeued := time.Now()
+	if d := c.next(t); !d.Redelivered() {
+		t.Error("Expected redelivered message")
+	}
+	if elapsed := time.Since(requeued); elapsed >= 50*time.Millisecond {
+		t.Error("Requeued message delayed again:", elapsed)
+	}
+}
+
+func TestDelay_QueueBrowsesScheduledMessages(t *testing.T) {
+	q := amq.NewQueue(queue.NewScheduledHandler(queue.NewQueueHandler()))
+	defer q.Close()
+
+	q.Consume(testMsg{
+		routingKey: "delayed",
+		headers:    amq.Headers{"x-not-before": time.Now().Add(time.Hour)},
+	})
+	q.Consume(testMsg{routingKey: "immediate"})
+
+	msgs, err := q.Browse(nil, 0)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if len(msgs) != 2 || msgs[0].RoutingKey() != "immediate" || msgs[1].RoutingKey() != "delayed" {
+		t.Error("Unexpected messages browsed:", msgs)
+	}
+}
+
+func TestDelay_ScheduledMessagesDontCountTowardsLimits(t *testing.T) {
+	q := amq.NewQueue(
+		queue.NewScheduledHandler(queue.NewQueueHandler()),
+		amq.MaxLengthBytes(10),
+	)
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		q.Consume(testMsg{
+			headers: amq.Headers{"x-not-before": time.Now().Add(time.Hour)},
+			body:    make([]byte, 4),
+		})
+	}
+	for i := 0; i < 2; i++ {
+		q.Consume(testMsg{body: make([]byte, 4)})
+	}
+
+	if q.Len() != 2 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 2)
+	}
+}
+
+func TestDelay_DueMessagesCountTowardsLimits(t *testing.T) {
+	q := amq.NewQueue(
+		queue.NewScheduledHandler(queue.NewQueueHandler()),
+		amq.MaxLengthBytes(10),
+	)
+	defer q.Close()
+
+	q.Consume(testMsg{routingKey: "first", body: make([]byte, 4)})
+	q.Consume(testMsg{routingKey: "second", body: make([]byte, 4)})
+	q.Consume(testMsg{
+		routingKey: "delayed",
+		headers:    amq.Headers{"x-not-before": time.Now().Add(50 * time.Millisecond)},
+		body:       make([]byte, 4),
+	})
+
+	time.Sleep(100 * time.Millisecond)
+
+	msgs, err := q.Browse(nil, 0)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if len(msgs) != 2 || msgs[0].RoutingKey() != "second" || msgs[1].RoutingKey() != "delayed" {
+		t.Error("Unexpected messages browsed:", msgs)
+	}
+}
+
+func TestDelay_ExchangeRoutesDelayedMessagesWhenDue(t *testing.T) {
+	returns := make(messageConsumer, 1)
+	ex := amq.NewExchange(matcher.Direct, amq.DelayedDelivery(), amq.ReturnTo(returns))
+
+	c := make(messageConsumer, 1)
+	ex.BindTo(&amq.Binding{Key: "key", Consumer: c})
+
+	msg := testMsg{
+		routingKey: "key",
+		headers:    amq.Headers{"x-delay": 50},
+	}
+
+	if result := ex.Publish(msg); !result.Delayed || result.Routed() {
+		t.Error("Unexpected publish result:", result)
+	}
+	c.none(t)
+
+	if msg := c.next(t); msg.RoutingKey() != "key" {
+		t.Error("Unexpected message received:", msg.RoutingKey())
+	}
+
+	msg.routingKey = "none"
+	if result := ex.Publish(msg, amq.Mandatory()); result.Returned {
+		t.Error("Unexpected delayed message returned")
+	}
+	returns.none(t)
+
+	if msg := returns.next(t); msg.RoutingKey() != "none" {
+		t.Error("Unexpected message returned:", msg.RoutingKey())
+	}
+}
@@ -0,0 +1,491 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDeliveryNotFound = errors.New("Queue: Delivery not found")
+	ErrQueueClosed      = errors.New("Queue: Queue closed")
+)
+
+// Delivery is a Message wrapper passed by Queue to subscribed consumers.
+//
+// Deliveries to consumers subscribed with ManualAck() option are tracked by
+// Queue until they are settled by one of Ack(), Nack() or Reject() calls,
+// unsettled deliveries are requeued when consumer unsubscribes.
+//
+// Delivery does not implement BasicProperties interface directly, use
+// PropertiesOf() to read properties of wrapped Message.
+type Delivery struct {
+	Message
+	tag         uint64
+	redelivered bool
+	expiresAt   time.Time
+	queue       *Queue
+	sub         *subscription
+
+	// stored is a tag of message copy stored by DurableQueueHandler, zero
+	// if there is none
+	stored uint64
+}
+
+// DeliveryTag returns number identifying delivery within Queue.
+func (self *Delivery) DeliveryTag() uint64 {
+	return self.tag
+}
+
+// Redelivered reports whatever message was previously delivered and requeued.
+func (self *Delivery) Redelivered() bool {
+	return self.redelivered
+}
+
+// Ack acknowledges delivery, when multiple is true all unsettled deliveries
+// to the same consumer, up to and including this one, are acknowledged.
+//
+// It's safe to call this method from multiple goroutines, including from
+// within consumer's Consume() call.
+//
+// If delivery was already settled, or consumer was not subscribed with
+// ManualAck() option the returned error will be of type: ErrDeliveryNotFound
+func (self *Delivery) Ack(multiple bool) error {
+	return self.queue.settle(self, multiple, true, false)
+}
+
+// Nack negatively acknowledges delivery, when multiple is true all unsettled
+// deliveries to the same consumer, up to and including this one, are settled.
+//
+// Settled messages are enqueued again when requeue is true, or dropped
+// (dead-lettered, if Queue is configured so) otherwise.
+func (self *Delivery) Nack(multiple, requeue bool) error {
+	return self.queue.settle(self, multiple, false, requeue)
+}
+
+// Reject negatively acknowledges single delivery, see Nack().
+func (self *Delivery) Reject(requeue bool) error {
+	return self.queue.settle(self, false, false, requeue)
+}
+
+func (self *Delivery) unwrap() Message {
+	return self.Message
+}
+
+// SubscribeOption configures consumer subscription, see Queue.SubscribeWith().
+type SubscribeOption func(*subscription)
+
+// ManualAck makes Queue track deliveries to consumer until they are settled.
+//
+// Without this option deliveries are considered acknowledged as soon
+// as they are passed to consumer.
+func ManualAck() SubscribeOption {
+	return func(sub *subscription) {
+		sub.manualAck = true
+	}
+}
+
+// Prefetch limits number of unsettled deliveries passed to consumer, and
+// optionally their total body size in bytes, zero means no limit.
+//
+// Queue skips consumers which reached their limit, size limit may be exceeded
+// by a single message. Limits are effective only with ManualAck() option.
+func Prefetch(count, size int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.prefetchCount = count
+		sub.prefetchSize = size
+	}
+}
+
+// defaultDeliveryBuffer is a default number of deliveries buffered
+// for consumer, see DeliveryBuffer().
+const defaultDeliveryBuffer = 16
+
+// DeliveryBuffer sets number of deliveries buffered for consumer, while it's
+// busy consuming previous ones, default buffer size is 16.
+//
+// Queue skips consumers with full buffers, values below 1 are treated as 1.
+func DeliveryBuffer(size int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.bufferSize = size
+	}
+}
+
+type subscription struct {
+	consumer      MessageConsumer
+	manualAck     bool
+	prefetchCount int
+	prefetchSize  int
+	bufferSize    int
+	priority      int
+	weight        int
+
+	// Guarded by Queue.mu
+	unacked     []*Delivery
+	unackedSize int
+
+	// Guarded by mu, shared with delivery goroutine
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []*Delivery
+	finished bool
+	stopped  chan struct{}
+}
+
+func newSubscription(consumer MessageConsumer, opts []SubscribeOption) *subscription {
+	sub := &subscription{
+		consumer:   consumer,
+		bufferSize: defaultDeliveryBuffer,
+		stopped:    make(chan struct{}),
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	if sub.bufferSize < 1 {
+		sub.bufferSize = 1
+	}
+
+	if sub.weight < 1 {
+		sub.weight = 1
+	}
+
+	return sub
+}
+
+// push buffers delivery for delivery goroutine.
+func (self *subscription) push(d *Delivery) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.pending = append(self.pending, d)
+	self.cond.Signal()
+}
+
+// next returns next buffered delivery, blocking until one is available,
+// false is returned when subscription is finished and buffer is empty.
+func (self *subscription) next() (*Delivery, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for len(self.pending) == 0 && !self.finished {
+		self.cond.Wait()
+	}
+
+	if len(self.pending) == 0 {
+		return nil, false
+	}
+
+	d := self.pending[0]
+	self.pending[0] = nil
+	self.pending = self.pending[1:]
+
+	return d, true
+}
+
+// busy reports whatever delivery buffer is full.
+func (self *subscription) busy() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return len(self.pending) >= self.bufferSize
+}
+
+// finish makes delivery goroutine exit once buffer is empty, when drop
+// is true buffered deliveries are discarded and returned.
+func (self *subscription) finish(drop bool) []*Delivery {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	var pending []*Delivery
+	if drop {
+		pending = self.pending
+		self.pending = nil
+	}
+
+	self.finished = true
+	self.cond.Broadcast()
+
+	return pending
+}
+
+// RedeliveredMessage is an interface implemented by messages held in Queue,
+// which were previously delivered and requeued.
+type RedeliveredMessage interface {
+	Redelivered() bool
+}
+
+// heldMessage wraps messages held by QueueHandler, carrying Queue metadata.
+type heldMessage struct {
+	Message
+	expiresAt   time.Time
+	notBefore   time.Time
+	redelivered bool
+}
+
+// NewHeldMessage returns message wrapped with Queue metadata, like messages
+// passed by Queue to QueueHandler. It's meant for handlers bringing back
+// messages from storage, see ExpiringMessage and RedeliveredMessage.
+func NewHeldMessage(msg Message, expiresAt time.Time, redelivered bool) Message {
+	return &heldMessage{
+		Message:     msg,
+		expiresAt:   expiresAt,
+		redelivered: redelivered,
+	}
+}
+
+func (self *heldMessage) ExpiresAt() time.Time {
+	return self.expiresAt
+}
+
+func (self *heldMessage) NotBefore() time.Time {
+	return self.notBefore
+}
+
+func (self *heldMessage) Redelivered() bool {
+	return self.redelivered
+}
+
+func (self *heldMessage) unwrap() Message {
+	return self.Message
+}
+
+type messageWrapper interface {
+	unwrap() Message
+}
+
+func (self *Queue) newDelivery(sub *subscription, taken *takenMessage) *Delivery {
+	d := &Delivery{
+		Message: taken.msg,
+		queue:   self,
+		sub:     sub,
+		stored:  taken.tag,
+	}
+
+	if h, ok := taken.msg.(*heldMessage); ok {
+		d.Message = h.Message
+		d.redelivered = h.redelivered
+		d.expiresAt = h.expiresAt
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.deliveryTag++
+	d.tag = self.deliveryTag
+
+	if sub.manualAck {
+		sub.unacked = append(sub.unacked, d)
+		sub.unackedSize += len(d.Body())
+	}
+
+	return d
+}
+
+func (self *Queue) settle(d *Delivery, multiple, ack, requeue bool) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.closed {
+		return ErrQueueClosed
+	}
+
+	unacked := d.sub.unacked
+	i := sort.Search(len(unacked), func(i int) bool {
+		return unacked[i].tag >= d.tag
+	})
+	if i == len(unacked) || unacked[i] != d {
+		return ErrDeliveryNotFound
+	}
+
+	var settled []*Delivery
+	if multiple {
+		settled = append(settled, unacked[:i+1]...)
+		d.sub.unacked = append(unacked[:0], unacked[i+1:]...)
+	} else {
+		settled = append(settled, d)
+		d.sub.unacked = append(unacked[:i], unacked[i+1:]...)
+	}
+
+	for _, s := range settled {
+		d.sub.unackedSize -= len(s.Body())
+	}
+
+	switch {
+	case ack:
+		for _, s := range settled {
+			self.release(s)
+		}
+
+	case requeue:
+		self.requeue(settled)
+
+	default:
+		for _, s := range settled {
+			self.deadLetterLocked(DeadLetterRejected, s.Message)
+			self.release(s)
+		}
+	}
+
+	self.wakeup()
+	return nil
+}
+
+// expired reports whatever delivered message deadline passed at given time.
+func (self *Delivery) expired(now time.Time) bool {
+	return !self.expiresAt.IsZero() && !now.Before(self.expiresAt)
+}
+
+// expire settles buffered delivery which expired before it was passed
+// to consumer, and dead-letters it.
+func (self *Queue) expire(d *Delivery) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if d.sub.manualAck {
+		unacked := d.sub.unacked
+		i := sort.Search(len(unacked), func(i int) bool {
+			return unacked[i].tag >= d.tag
+		})
+		if i == len(unacked) || unacked[i] != d {
+			// Already settled, e.g. requeued on unsubscribe
+			return
+		}
+
+		d.sub.unacked = append(unacked[:i], unacked[i+1:]...)
+		d.sub.unackedSize -= len(d.Body())
+	}
+
+	if !self.closed {
+		self.deadLetterLocked(DeadLetterExpired, d.Message)
+		self.release(d)
+	}
+}
+
+// requeue passes messages back to inputHandler, self.mu has to be held.
+func (self *Queue) requeue(deliveries []*Delivery) {
+	for _, d := range deliveries {
+		self.returnMessage(d, true)
+	}
+}
+
+// returnMessage passes single message back to inputHandler, self.mu has to
+// be held.
+func (self *Queue) returnMessage(d *Delivery, redelivered bool) {
+	self.returns = append(self.returns, &takenMessage{
+		msg: &heldMessage{
+			Message:     d.Message,
+			expiresAt:   d.expiresAt,
+			redelivered: redelivered,
+		},
+		tag: d.stored,
+	})
+	self.notifyReturned()
+}
+
+// notifyReturned signals inputHandler that messages were returned or settled,
+// self.mu has to be held.
+func (self *Queue) notifyReturned() {
+	select {
+	case self.returned <- struct{}{}:
+	default:
+	}
+}
+
+// cancel stops delivery goroutine of unsubscribed consumer, and requeues
+// its deliveries in delivery order. Buffered deliveries are requeued as they
+// were never delivered, other unsettled deliveries are requeued as redelivered.
+func (self *Queue) cancel(sub *subscription) {
+	pending := sub.finish(true)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if !sub.manualAck {
+		// Only buffered deliveries are not settled
+		for _, d := range pending {
+			self.returnMessage(d, d.redelivered)
+		}
+		return
+	}
+
+	undelivered := make(map[*Delivery]struct{}, len(pending))
+	for _, d := range pending {
+		undelivered[d] = struct{}{}
+	}
+
+	for _, d := range sub.unacked {
+		if _, found := undelivered[d]; found {
+			self.returnMessage(d, d.redelivered)
+		} else {
+			self.returnMessage(d, true)
+		}
+	}
+	sub.unacked = nil
+	sub.unackedSize = 0
+}
+
+// outstanding returns number of deliveries buffered for consumer, or not
+// settled yet.
+func (self *Queue) outstanding(sub *subscription) int {
+	if sub.manualAck {
+		// Unsettled deliveries include buffered ones
+		self.mu.Lock()
+		defer self.mu.Unlock()
+
+		return len(sub.unacked)
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return len(sub.pending)
+}
+
+// wakeup signals outputHandler that consumers capacity may have changed.
+func (self *Queue) wakeup() {
+	select {
+	case self.capacity <- struct{}{}:
+	default:
+	}
+}
+
+// hasCapacity reports whatever consumer is below its prefetch limits, and its
+// delivery buffer is not full.
+func (self *Queue) hasCapacity(sub *subscription) bool {
+	if sub.busy() {
+		return false
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if sub.prefetchCount > 0 && len(sub.unacked) >= sub.prefetchCount {
+		return false
+	}
+
+	if sub.prefetchSize > 0 && sub.unackedSize >= sub.prefetchSize {
+		return false
+	}
+
+	return true
+}
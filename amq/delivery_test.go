@@ -0,0 +1,275 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+	"github.com/canni/paperboymq/queue"
+)
+
+func TestDelivery_AutoAckDeliveryCantBeSettled(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.Subscribe(c)
+	q.Consume(testMsg{routingKey: "key"})
+
+	d := c.next(t)
+	if d.RoutingKey() != "key" {
+		t.Error("Unexpected message delivered")
+	}
+	if d.Redelivered() {
+		t.Error("Unexpected redelivered flag")
+	}
+
+	if err := d.Ack(false); err != amq.ErrDeliveryNotFound {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestDelivery_AckSettlesDeliveryOnce(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{})
+
+	d := c.next(t)
+	if err := d.Ack(false); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := d.Ack(false); err != amq.ErrDeliveryNotFound {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestDelivery_DeliveryTagsAreIncreasing(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 10)
+	q.Subscribe(c)
+
+	var last uint64
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{})
+		d := c.next(t)
+		if d.DeliveryTag() <= last {
+			t.Errorf("Unexpected delivery tag %d after %d", d.DeliveryTag(), last)
+		}
+		last = d.DeliveryTag()
+	}
+}
+
+func TestDelivery_NackWithRequeueRedeliversMessage(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{routingKey: "key"})
+
+	d := c.next(t)
+	if err := d.Nack(false, true); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	d = c.next(t)
+	if !d.Redelivered() {
+		t.Error("Expected redelivered flag")
+	}
+	if d.RoutingKey() != "key" {
+		t.Error("Unexpected message delivered")
+	}
+}
+
+func TestDelivery_RedeliveredMessageSurvivesPaging(t *testing.T) {
+	q := amq.NewQueue(queue.NewLazyHandler(1, queue.PageDir(t.TempDir())))
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck(), amq.Prefetch(1, 0))
+	for _, key := range []string{"0", "1", "2"} {
+		q.Consume(amq.NewMessageBuilder().RoutingKey(key).Build())
+	}
+
+	// Requeued message is paged out behind the others
+	c.next(t).Nack(false, true)
+	c.next(t).Ack(false)
+	c.next(t).Ack(false)
+
+	d := c.next(t)
+	if !d.Redelivered() || d.RoutingKey() != "0" {
+		t.Error("Expected redelivered message")
+	}
+	if _, ok := d.Message.(*amq.BasicMessage); !ok {
+		t.Errorf("Unexpected message type %T", d.Message)
+	}
+}
+
+func TestDelivery_RejectWithoutRequeueDropsMessage(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{})
+
+	if err := c.next(t).Reject(false); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	c.none(t)
+	if q.Len() != 0 {
+		t.Error("Unexpected queue length:", q.Len())
+	}
+}
+
+func TestDelivery_MultipleAckSettlesPreviousDeliveries(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 3)
+	q.SubscribeWith(c, amq.ManualAck())
+
+	for i := 0; i < 3; i++ {
+		q.Consume(testMsg{})
+	}
+
+	d1, d2, d3 := c.next(t), c.next(t), c.next(t)
+
+	if err := d2.Ack(true); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := d1.Ack(false); err != amq.ErrDeliveryNotFound {
+		t.Error("Unexpected error:", err)
+	}
+	if err := d3.Ack(false); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestDelivery_UnsubscribeRequeuesUnsettledDeliveries(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 2)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{})
+	q.Consume(testMsg{})
+
+	d := c.next(t)
+	d.Ack(false)
+	d = c.next(t)
+
+	q.Unsubscribe(c)
+
+	if err := d.Ack(false); err != amq.ErrDeliveryNotFound {
+		t.Error("Unexpected error:", err)
+	}
+
+	other := make(deliveryConsumer, 1)
+	q.Subscribe(other)
+
+	if !other.next(t).Redelivered() {
+		t.Error("Expected redelivered flag")
+	}
+}
+
+func TestDelivery_CanBeSettledFromWithinConsume(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+
+	c := &ackingConsumer{}
+	q.SubscribeWith(c, amq.ManualAck())
+
+	for i := 0; i < 100; i++ {
+		q.Consume(testMsg{})
+	}
+	q.Close()
+
+	if c.acked != 100 {
+		t.Errorf("Unexpected acknowledged count %d expected %d", c.acked, 100)
+	}
+}
+
+func TestDelivery_SettleAfterCloseReturnsError(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+
+	c := make(deliveryConsumer, 1)
+	q.SubscribeWith(c, amq.ManualAck())
+	q.Consume(testMsg{})
+
+	d := c.next(t)
+	q.Close()
+
+	if err := d.Ack(false); err != amq.ErrQueueClosed {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestDelivery_PropertiesOfDelivery(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 1)
+	q.Subscribe(c)
+	q.Consume(amq.NewMessageBuilder().MessageId("id").Build())
+
+	if amq.PropertiesOf(c.next(t)).MessageId != "id" {
+		t.Error("Unexpected message properties")
+	}
+}
+
+type deliveryConsumer chan *amq.Delivery
+
+func (self deliveryConsumer) Consume(msg amq.Message) {
+	self <- msg.(*amq.Delivery)
+}
+
+func (self deliveryConsumer) next(t *testing.T) *amq.Delivery {
+	select {
+	case d := <-self:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery not received")
+	}
+
+	return nil
+}
+
+func (self deliveryConsumer) none(t *testing.T) {
+	select {
+	case <-self:
+		t.Error("Unexpected delivery received")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+type ackingConsumer struct {
+	acked int
+}
+
+func (self *ackingConsumer) Consume(msg amq.Message) {
+	if msg.(*amq.Delivery).Ack(false) == nil {
+		self.acked++
+	}
+}
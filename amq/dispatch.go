@@ -0,0 +1,226 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DispatchStrategy sets Dispatcher used by Queue to choose consumer for next
+// message, newDispatcher is called for each consumer priority level. Default
+// strategy is NewRoundRobinDispatcher.
+func DispatchStrategy(newDispatcher func() Dispatcher) QueueOption {
+	return func(q *Queue) {
+		q.newDispatcher = newDispatcher
+	}
+}
+
+// DispatchWeight sets relative weight of consumer used by weighted
+// dispatchers, default weight is 1, values below 1 are treated as 1.
+func DispatchWeight(weight int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.weight = weight
+	}
+}
+
+// NewRoundRobinDispatcher returns Dispatcher choosing consumers in turn,
+// ineligible consumers are skipped.
+func NewRoundRobinDispatcher() Dispatcher {
+	return &roundRobinDispatcher{newRoundRobinHandler()}
+}
+
+type roundRobinDispatcher struct {
+	*consumerRoundRobin
+}
+
+func (self *roundRobinDispatcher) Next(state DispatchState) MessageConsumer {
+	for i := 0; i < self.Len(); i++ {
+		if consumer := self.consumerRoundRobin.Next(); state.Eligible(consumer) {
+			return consumer
+		}
+	}
+
+	return nil
+}
+
+// NewWeightedRoundRobinDispatcher returns Dispatcher choosing consumers in turn,
+// proportionally to their weights, using smooth weighted round-robin, so
+// consumers with higher weight are interleaved with others rather than chosen
+// in bursts. Ineligible consumers are skipped.
+func NewWeightedRoundRobinDispatcher() Dispatcher {
+	return &weightedDispatcher{
+		consumerSet: newConsumerSet(),
+		current:     make(map[MessageConsumer]int),
+	}
+}
+
+type weightedDispatcher struct {
+	*consumerSet
+	current map[MessageConsumer]int
+}
+
+func (self *weightedDispatcher) Remove(consumer MessageConsumer) error {
+	if err := self.consumerSet.Remove(consumer); err != nil {
+		return err
+	}
+
+	delete(self.current, consumer)
+	return nil
+}
+
+func (self *weightedDispatcher) Next(state DispatchState) MessageConsumer {
+	var best MessageConsumer
+	total := 0
+
+	for _, consumer := range self.list {
+		if !state.Eligible(consumer) {
+			continue
+		}
+
+		weight := state.Weight(consumer)
+		total += weight
+		self.current[consumer] += weight
+
+		if best == nil || self.current[consumer] > self.current[best] {
+			best = consumer
+		}
+	}
+
+	if best != nil {
+		self.current[best] -= total
+	}
+
+	return best
+}
+
+// NewLeastOutstandingDispatcher returns Dispatcher choosing eligible consumer
+// with the least outstanding deliveries, ties are resolved in a round-robin
+// fashion.
+func NewLeastOutstandingDispatcher() Dispatcher {
+	return &leastOutstandingDispatcher{newRoundRobinHandler()}
+}
+
+type leastOutstandingDispatcher struct {
+	*consumerRoundRobin
+}
+
+func (self *leastOutstandingDispatcher) Next(state DispatchState) MessageConsumer {
+	if self.Len() == 0 {
+		return nil
+	}
+
+	var best MessageConsumer
+	least := 0
+
+	for i := 0; i < self.Len(); i++ {
+		consumer := self.consumerRoundRobin.Next()
+		if !state.Eligible(consumer) {
+			continue
+		}
+
+		if outstanding := state.Outstanding(consumer); best == nil || outstanding < least {
+			best, least = consumer, outstanding
+		}
+	}
+
+	// Start next scan from the following consumer
+	self.consumerRoundRobin.Next()
+
+	return best
+}
+
+// NewRandomDispatcher returns Dispatcher choosing eligible consumers at random.
+func NewRandomDispatcher() Dispatcher {
+	return &randomDispatcher{
+		consumerSet: newConsumerSet(),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+type randomDispatcher struct {
+	*consumerSet
+	rand *rand.Rand
+}
+
+func (self *randomDispatcher) Next(state DispatchState) MessageConsumer {
+	var chosen MessageConsumer
+	eligible := 0
+
+	// Reservoir sampling, so eligible consumers are equally likely chosen
+	for _, consumer := range self.list {
+		if state.Eligible(consumer) {
+			eligible++
+			if self.rand.Intn(eligible) == 0 {
+				chosen = consumer
+			}
+		}
+	}
+
+	return chosen
+}
+
+// consumerSet is a list of consumers with constant time removal, order
+// of consumers is not preserved.
+type consumerSet struct {
+	list    []MessageConsumer
+	indexes map[MessageConsumer]int
+}
+
+func newConsumerSet() *consumerSet {
+	return &consumerSet{
+		indexes: make(map[MessageConsumer]int),
+	}
+}
+
+func (self *consumerSet) Len() int {
+	return len(self.list)
+}
+
+func (self *consumerSet) Add(consumer MessageConsumer) error {
+	if _, found := self.indexes[consumer]; found {
+		return ErrConsumerAlreadySubscribed
+	}
+
+	self.indexes[consumer] = len(self.list)
+	self.list = append(self.list, consumer)
+	return nil
+}
+
+func (self *consumerSet) Remove(consumer MessageConsumer) error {
+	i, found := self.indexes[consumer]
+	if !found {
+		return ErrConsumerNotFound
+	}
+
+	last := len(self.list) - 1
+	self.list[i] = self.list[last]
+	self.indexes[self.list[i]] = i
+	self.list[last] = nil
+	self.list = self.list[:last]
+
+	delete(self.indexes, consumer)
+	return nil
+}
+
+// Ensure dispatchers implement Dispatcher interface
+var (
+	_ Dispatcher = &roundRobinDispatcher{}
+	_ Dispatcher = &weightedDispatcher{}
+	_ Dispatcher = &leastOutstandingDispatcher{}
+	_ Dispatcher = &randomDispatcher{}
+)
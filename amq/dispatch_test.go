@@ -0,0 +1,178 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"testing"
+)
+
+func TestDispatchers_SkipIneligibleConsumers(t *testing.T) {
+	for _, d := range []Dispatcher{
+		NewRoundRobinDispatcher(),
+		NewWeightedRoundRobinDispatcher(),
+		NewLeastOutstandingDispatcher(),
+		NewRandomDispatcher(),
+	} {
+		if d.Next(eligibleFunc(nil)) != nil {
+			t.Errorf("%T: Unexpected consumer returned from empty dispatcher", d)
+		}
+
+		c1, c2, c3 := make(testConsumer), make(testConsumer), make(testConsumer)
+		for _, c := range []MessageConsumer{c1, c2, c3} {
+			if err := d.Add(c); err != nil {
+				t.Errorf("%T: Unexpected error: %v", d, err)
+			}
+		}
+
+		if err := d.Add(c1); err != ErrConsumerAlreadySubscribed {
+			t.Errorf("%T: Expected ErrConsumerAlreadySubscribed not returned", d)
+		}
+
+		onlyC2 := eligibleFunc(func(c MessageConsumer) bool { return c == c2 })
+		for i := 0; i < 10; i++ {
+			if c := d.Next(onlyC2); c != c2 {
+				t.Errorf("%T: Unexpected consumer returned", d)
+			}
+		}
+
+		if err := d.Remove(c2); err != nil {
+			t.Errorf("%T: Unexpected error: %v", d, err)
+		}
+
+		if err := d.Remove(c2); err != ErrConsumerNotFound {
+			t.Errorf("%T: Expected ErrConsumerNotFound not returned", d)
+		}
+
+		if c := d.Next(onlyC2); c != nil {
+			t.Errorf("%T: Unexpected consumer returned", d)
+		}
+
+		if d.Len() != 2 {
+			t.Errorf("%T: Unexpected length %d, expected %d", d, d.Len(), 2)
+		}
+	}
+}
+
+func TestWeightedRoundRobinDispatcher_InterleavesByWeight(t *testing.T) {
+	d := NewWeightedRoundRobinDispatcher()
+
+	a, b := make(testConsumer), make(testConsumer)
+	d.Add(a)
+	d.Add(b)
+
+	state := &testDispatchState{
+		weights: map[MessageConsumer]int{a: 3, b: 1},
+	}
+
+	expected := []MessageConsumer{a, a, b, a, a, a, b, a}
+	for i, e := range expected {
+		if c := d.Next(state); c != e {
+			t.Errorf("Unexpected consumer returned in step %d", i)
+		}
+	}
+}
+
+func TestLeastOutstandingDispatcher_ChoosesLeastBusyConsumer(t *testing.T) {
+	d := NewLeastOutstandingDispatcher()
+
+	a, b, c := make(testConsumer), make(testConsumer), make(testConsumer)
+	d.Add(a)
+	d.Add(b)
+	d.Add(c)
+
+	state := &testDispatchState{
+		outstanding: map[MessageConsumer]int{a: 3, b: 1, c: 2},
+	}
+
+	for i := 0; i < 3; i++ {
+		if next := d.Next(state); next != b {
+			t.Errorf("Unexpected consumer returned in step %d", i)
+		}
+	}
+
+	// Ties are resolved in turn
+	state.outstanding[b] = 3
+	state.outstanding[c] = 3
+
+	seen := make(map[MessageConsumer]int)
+	for i := 0; i < 30; i++ {
+		seen[d.Next(state)]++
+	}
+
+	for _, consumer := range []MessageConsumer{a, b, c} {
+		if seen[consumer] != 10 {
+			t.Errorf("Unexpected tie resolution: %d", seen[consumer])
+		}
+	}
+}
+
+func TestRandomDispatcher_ChoosesAllConsumers(t *testing.T) {
+	d := NewRandomDispatcher()
+
+	consumers := []MessageConsumer{make(testConsumer), make(testConsumer), make(testConsumer)}
+	for _, c := range consumers {
+		d.Add(c)
+	}
+
+	seen := make(map[MessageConsumer]int)
+	for i := 0; i < 300; i++ {
+		seen[d.Next(eligibleFunc(func(MessageConsumer) bool { return true }))]++
+	}
+
+	for _, c := range consumers {
+		if seen[c] == 0 {
+			t.Error("Consumer never chosen")
+		}
+	}
+}
+
+// eligibleFunc is a DispatchState with all consumers equal, nil function
+// means no consumer is eligible.
+type eligibleFunc func(MessageConsumer) bool
+
+func (self eligibleFunc) Eligible(consumer MessageConsumer) bool {
+	return self != nil && self(consumer)
+}
+
+func (self eligibleFunc) Outstanding(MessageConsumer) int {
+	return 0
+}
+
+func (self eligibleFunc) Weight(MessageConsumer) int {
+	return 1
+}
+
+type testDispatchState struct {
+	outstanding map[MessageConsumer]int
+	weights     map[MessageConsumer]int
+}
+
+func (self *testDispatchState) Eligible(MessageConsumer) bool {
+	return true
+}
+
+func (self *testDispatchState) Outstanding(consumer MessageConsumer) int {
+	return self.outstanding[consumer]
+}
+
+func (self *testDispatchState) Weight(consumer MessageConsumer) int {
+	if w, found := self.weights[consumer]; found {
+		return w
+	}
+
+	return 1
+}
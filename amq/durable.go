@@ -0,0 +1,89 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+// DurableQueueHandler is an interface implemented by QueueHandlers storing
+// messages durably. Message removed by Remove() call stays stored until Queue
+// settles it, so messages delivered to consumers are recovered after a crash,
+// unless they were acknowledged.
+//
+// Tag() returns number identifying stored copy of message at the front
+// of queue, zero means message is not stored. Queue calls Settle() with that
+// number once message is acknowledged, dead-lettered, expired or dropped.
+// Messages taken by Queue but never settled, like ones left undelivered
+// on Close(), stay stored.
+type DurableQueueHandler interface {
+	QueueHandler
+	Tag() uint64
+	Settle(tag uint64)
+}
+
+// CheckedQueueHandler is an interface implemented by QueueHandlers which may
+// fail to enqueue message, like durable handlers failing to store it.
+//
+// Queue calls AddChecked() instead of Add(), message is enqueued only when
+// returned error is nil, otherwise the error is returned to publisher.
+type CheckedQueueHandler interface {
+	QueueHandler
+	AddChecked(Message) error
+}
+
+// takenMessage is a message taken from handler, along with tag of its stored
+// copy, see DurableQueueHandler.
+type takenMessage struct {
+	msg Message
+	tag uint64
+}
+
+// head returns message at the front of handler, it must be called only
+// by inputHandler.
+func (self *Queue) head() *takenMessage {
+	taken := &takenMessage{msg: self.handler.Peek()}
+	if durable, ok := self.handler.(DurableQueueHandler); ok {
+		taken.tag = durable.Tag()
+	}
+
+	return taken
+}
+
+// take dequeues message from handler and returns it, like remove() does, but
+// its stored copy is kept until returned tag is settled. It must be called
+// only by inputHandler.
+func (self *Queue) take() *takenMessage {
+	taken := self.head()
+	self.handler.Remove()
+	self.bytes -= len(taken.msg.Body())
+
+	return taken
+}
+
+// settleStored drops stored copy of message taken from handler, it must be
+// called only by inputHandler, or after it exited.
+func (self *Queue) settleStored(tag uint64) {
+	if tag != 0 {
+		self.handler.(DurableQueueHandler).Settle(tag)
+	}
+}
+
+// release passes tag of settled delivery to inputHandler, self.mu has
+// to be held.
+func (self *Queue) release(d *Delivery) {
+	if d.stored != 0 && !self.closed {
+		self.settled = append(self.settled, d.stored)
+		self.notifyReturned()
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/canni/paperboymq/amq"
+	"github.com/canni/paperboymq/queue"
+)
+
+func TestDurable_UnsettledDeliveriesSurviveCrash(t *testing.T) {
+	dir := t.TempDir()
+	wal := openWAL(t, dir)
+	defer wal.Close()
+
+	q := amq.NewQueue(wal)
+	defer q.ForceClose()
+
+	c := make(deliveryConsumer, 3)
+	q.SubscribeWith(c, amq.ManualAck())
+	for i := 0; i < 3; i++ {
+		publishPersistent(t, q, strconv.Itoa(i))
+	}
+
+	first := c.next(t)
+	c.next(t)
+	c.next(t)
+
+	first.Reject(true)
+	if d := c.next(t); !d.Redelivered() || d.RoutingKey() != "0" {
+		t.Error("Unexpected redelivery:", d.RoutingKey())
+	}
+
+	// Queue is not closed, as if process crashed
+	expectStored(t, dir, "1", "2", "0")
+}
+
+func TestDurable_CloseKeepsUndeliveredMessages(t *testing.T) {
+	dir := t.TempDir()
+	wal := openWAL(t, dir)
+
+	q := amq.NewQueue(wal)
+	for i := 0; i < 3; i++ {
+		publishPersistent(t, q, strconv.Itoa(i))
+	}
+	q.Close()
+
+	if err := wal.Close(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expectStored(t, dir, "0", "1", "2")
+}
+
+func TestDurable_CloseSettlesAcknowledgedDeliveries(t *testing.T) {
+	dir := t.TempDir()
+	wal := openWAL(t, dir)
+
+	q := amq.NewQueue(wal)
+	c := make(deliveryConsumer, 3)
+	q.SubscribeWith(c, amq.ManualAck())
+	for i := 0; i < 3; i++ {
+		publishPersistent(t, q, strconv.Itoa(i))
+	}
+
+	c.next(t).Ack(false)
+	c.next(t)
+	c.next(t)
+	q.Close()
+
+	if err := wal.Close(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expectStored(t, dir, "1", "2")
+}
+
+func TestDurable_PublishReturnsHandlerError(t *testing.T) {
+	wal := openWAL(t, t.TempDir())
+	wal.Close()
+
+	q := amq.NewQueue(wal)
+	defer q.Close()
+
+	msg := amq.NewMessageBuilder().DeliveryMode(amq.Persistent).Build()
+	if err := q.Publish(msg); err != queue.ErrHandlerClosed {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := q.Publish(testMsg{}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if q.Len() != 1 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 1)
+	}
+}
+
+func openWAL(t *testing.T, dir string) *queue.WALHandler {
+	wal, err := queue.NewWALHandler(dir)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	return wal
+}
+
+func publishPersistent(t *testing.T, q *amq.Queue, key string) {
+	msg := amq.NewMessageBuilder().
+		RoutingKey(key).
+		DeliveryMode(amq.Persistent).
+		Build()
+
+	if err := q.Publish(msg); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+// expectStored checks messages recovered from log in given directory.
+func expectStored(t *testing.T, dir string, keys ...string) {
+	wal := openWAL(t, dir)
+	defer wal.Close()
+
+	if wal.Len() != len(keys) {
+		t.Fatalf("Unexpected stored messages count, expected %d got %d", len(keys), wal.Len())
+	}
+
+	for _, key := range keys {
+		if msg := wal.Peek(); msg.RoutingKey() != key {
+			t.Errorf("Invalid message, expected %s got %s", key, msg.RoutingKey())
+		}
+		wal.Remove()
+	}
+}
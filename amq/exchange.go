@@ -19,11 +19,13 @@ package amq
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var (
 	ErrAlreadyBound    = errors.New("Exchange: Already bound to this binding")
 	ErrBindingNotFound = errors.New("Exchange: Binding not found")
+	ErrBindingCycle    = errors.New("Exchange: Binding would create a cycle")
 )
 
 // Exchange is a base AMQ entity, it supports goroutine-safe concurrent access.
@@ -33,38 +35,268 @@ var (
 //
 // Exchange delivers messages to bound bindings based on result of Matcher.Matches()
 // call. Consumer bound via multiple bindings, will receive message only once.
+//
+// When Matcher implements IndexingMatcher interface, matching bindings are
+// looked up in its BindingIndex. When Matcher implements SelectingMatcher
+// interface, every message is delivered to single binding chosen by its
+// BindingSelector.
+//
+// Exchange configured with DelayedDelivery() option holds delayed messages
+// until they're due.
 type Exchange struct {
 	matcher   Matcher
+	selector  BindingSelector
+	index     BindingIndex
 	consumers map[*Binding]MessageConsumer
+	returns   MessageConsumer
+	alternate MessageConsumer
+	delayed   bool
 	mu        sync.RWMutex
 }
 
-func NewExchange(matcher Matcher) *Exchange {
-	return &Exchange{
+// ExchangeOption configures Exchange, see NewExchange().
+type ExchangeOption func(*Exchange)
+
+// NewExchange returns initialized Exchange, configured with given options.
+func NewExchange(matcher Matcher, opts ...ExchangeOption) *Exchange {
+	ex := &Exchange{
 		matcher:   matcher,
 		consumers: make(map[*Binding]MessageConsumer),
 	}
+
+	switch m := matcher.(type) {
+	case SelectingMatcher:
+		ex.selector = m.NewSelector()
+	case IndexingMatcher:
+		ex.index = m.NewIndex()
+	}
+
+	for _, opt := range opts {
+		opt(ex)
+	}
+
+	return ex
 }
 
+// ReturnTo sets consumer to which Exchange hands back unroutable messages
+// published with Mandatory() option, like AMQP basic.return does.
+func ReturnTo(consumer MessageConsumer) ExchangeOption {
+	return func(ex *Exchange) {
+		ex.returns = consumer
+	}
+}
+
+// AlternateExchange sets consumer (typically *Exchange) which receives messages
+// not matching any binding, like alternate-exchange exchange argument.
+//
+// Message routed to alternate consumer is not returned, unless alternate
+// consumer is *Exchange which did not route it either.
+func AlternateExchange(consumer MessageConsumer) ExchangeOption {
+	return func(ex *Exchange) {
+		ex.alternate = consumer
+	}
+}
+
+// DelayedDelivery makes Exchange hold delayed messages (see NotBefore())
+// until they're due, like x-delayed-message exchange type does. Messages are
+// routed to bindings matching at the time they're due, from a separate
+// goroutine, publish options apply to the deferred routing too. Delay set by
+// x-delay header is counted from the time message is published, and it's not
+// applied again once message is routed.
+func DelayedDelivery() ExchangeOption {
+	return func(ex *Exchange) {
+		ex.delayed = true
+	}
+}
+
+// PublishOption configures single Exchange.Publish() call.
+type PublishOption func(*publishing)
+
+// Mandatory makes Exchange return message to consumer set by ReturnTo()
+// option, when message was not routed to any consumer.
+func Mandatory() PublishOption {
+	return func(p *publishing) {
+		p.mandatory = true
+	}
+}
+
+type publishing struct {
+	mandatory bool
+}
+
+// PublishResult reports how message was routed by Exchange.Publish().
+type PublishResult struct {
+	// Bindings is a count of bindings matching message, including bindings
+	// of exchanges bound to Exchange.
+	Bindings int
+
+	// Consumers is a count of distinct consumers, other than exchanges, which
+	// received message, including consumers reached through bound and
+	// alternate exchanges.
+	Consumers int
+
+	// Alternate reports whatever message was passed to alternate exchange.
+	Alternate bool
+
+	// Returned reports whatever message was handed back to return consumer.
+	Returned bool
+
+	// Delayed reports whatever message was held by exchange with delayed
+	// delivery, to be routed once it's due.
+	Delayed bool
+}
+
+// Routed reports whatever message was delivered to at least one consumer.
+func (self PublishResult) Routed() bool {
+	return self.Consumers > 0
+}
+
+// Consume routes message to matching bindings, see Publish().
 func (self *Exchange) Consume(msg Message) {
+	self.Publish(msg)
+}
+
+// Publish routes message to consumers of matching bindings, configured
+// with given options, and reports the result. It's safe to call this method
+// from multiple goroutines.
+//
+// Exchanges bound to Exchange route message further within the same call,
+// every consumer in the whole exchange graph receives message only once.
+func (self *Exchange) Publish(msg Message, opts ...PublishOption) PublishResult {
+	var p publishing
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	r := &routing{
+		sent: map[MessageConsumer]struct{}{self: struct{}{}},
+		root: self,
+		opts: opts,
+	}
+	self.route(msg, r)
+
+	if p.mandatory && !r.result.Routed() && !r.result.Delayed && self.returns != nil {
+		self.returns.Consume(msg)
+		r.result.Returned = true
+	}
+
+	return r.result
+}
+
+// routing is a state of single message routing through exchange graph.
+type routing struct {
+	sent   map[MessageConsumer]struct{}
+	root   *Exchange
+	opts   []PublishOption
+	result PublishResult
+}
+
+// deliver passes message to consumer, unless it already received it.
+func (self *routing) deliver(msg Message, consumer MessageConsumer) {
+	if _, alreadySent := self.sent[consumer]; alreadySent {
+		return
+	}
+	self.sent[consumer] = struct{}{}
+
+	if ex, ok := consumer.(*Exchange); ok {
+		ex.route(msg, self)
+		return
+	}
+
+	consumer.Consume(msg)
+	self.result.Consumers++
+}
+
+func (self *Exchange) route(msg Message, r *routing) {
+	if self.delay(msg, r) {
+		return
+	}
+
+	if self.routeBindings(msg, r) == 0 && self.alternate != nil {
+		r.result.Alternate = true
+		r.deliver(msg, self.alternate)
+	}
+}
+
+// delay schedules routing of message which is not due yet, when Exchange
+// supports delayed delivery, and reports whatever it did so.
+func (self *Exchange) delay(msg Message, r *routing) bool {
+	if !self.delayed {
+		return false
+	}
+
+	now := time.Now()
+	notBefore := NotBefore(msg, now)
+	if !notBefore.After(now) {
+		return false
+	}
+
+	// Publish options apply only to exchange message was published to
+	var opts []PublishOption
+	if r.root == self {
+		opts = r.opts
+	}
+
+	time.AfterFunc(notBefore.Sub(now), func() {
+		self.Publish(&dueMessage{Message: msg, notBefore: notBefore}, opts...)
+	})
+	r.result.Delayed = true
+
+	return true
+}
+
+// routeBindings delivers message over matching bindings, and returns their count.
+func (self *Exchange) routeBindings(msg Message, r *routing) int {
 	self.mu.RLock()
 	defer self.mu.RUnlock()
 
-	sent := make(map[MessageConsumer]struct{})
-
-	for binding, consumer := range self.consumers {
-		if _, alreadySent := sent[consumer]; alreadySent {
-			continue
+	var matched []*Binding
+	switch {
+	case self.selector != nil:
+		if binding := self.selector.Select(msg); binding != nil {
+			matched = append(matched, binding)
 		}
 
-		if self.matcher.Matches(msg, binding) {
-			consumer.Consume(msg)
-			sent[consumer] = struct{}{}
+	case self.index != nil:
+		matched = self.index.Match(msg)
+
+	default:
+		for binding := range self.consumers {
+			if self.matcher.Matches(msg, binding) {
+				matched = append(matched, binding)
+			}
 		}
 	}
+
+	r.result.Bindings += len(matched)
+	for _, binding := range matched {
+		r.deliver(msg, binding.Consumer)
+	}
+
+	return len(matched)
 }
 
+// BindTo binds Exchange to binding, it's safe to call this method from
+// multiple goroutines.
+//
+// If binding is already bound the returned error will be of type:
+// ErrAlreadyBound
+//
+// If binding consumer is *Exchange from witch this Exchange is reachable,
+// through bindings or alternate exchanges, the returned error will be of type:
+// ErrBindingCycle
 func (self *Exchange) BindTo(binding *Binding) error {
+	if ex, ok := binding.Consumer.(*Exchange); ok {
+		// Serializes exchange-to-exchange bindings, so no cycle can be created
+		// between the check and binding
+		topologyMu.Lock()
+		defer topologyMu.Unlock()
+
+		if ex.reaches(self, make(map[*Exchange]struct{})) {
+			return ErrBindingCycle
+		}
+	}
+
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
@@ -72,10 +304,27 @@ func (self *Exchange) BindTo(binding *Binding) error {
 		return ErrAlreadyBound
 	}
 
+	if self.selector != nil {
+		if err := self.selector.Add(binding); err != nil {
+			return err
+		}
+	}
+
+	if self.index != nil {
+		if err := self.index.Add(binding); err != nil {
+			return err
+		}
+	}
+
 	self.consumers[binding] = binding.Consumer
 	return nil
 }
 
+// UnbindFrom removes binding from Exchange, it's safe to call this method from
+// multiple goroutines.
+//
+// If binding is not bound the returned error will be of type:
+// ErrBindingNotFound
 func (self *Exchange) UnbindFrom(binding *Binding) error {
 	self.mu.Lock()
 	defer self.mu.Unlock()
@@ -84,10 +333,110 @@ func (self *Exchange) UnbindFrom(binding *Binding) error {
 		return ErrBindingNotFound
 	}
 
-	delete(self.consumers, binding)
+	self.unbind(binding)
 	return nil
 }
 
+// UnbindConsumer removes all bindings pointing at consumer and returns them,
+// it's safe to call this method from multiple goroutines.
+func (self *Exchange) UnbindConsumer(consumer MessageConsumer) []*Binding {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	bindings := self.bindingsFor(consumer)
+	for _, binding := range bindings {
+		self.unbind(binding)
+	}
+
+	return bindings
+}
+
+// unbind removes bound binding, self.mu has to be held.
+func (self *Exchange) unbind(binding *Binding) {
+	if self.selector != nil {
+		self.selector.Remove(binding)
+	}
+
+	if self.index != nil {
+		self.index.Remove(binding)
+	}
+
+	delete(self.consumers, binding)
+}
+
+// Bindings returns list of all bindings bound to Exchange, in no particular
+// order, it's safe to call this method from multiple goroutines.
+//
+// Returned bindings MUST NOT be modified.
+func (self *Exchange) Bindings() []*Binding {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	bindings := make([]*Binding, 0, len(self.consumers))
+	for binding := range self.consumers {
+		bindings = append(bindings, binding)
+	}
+
+	return bindings
+}
+
+// BindingsFor returns list of bindings pointing at consumer, in no particular
+// order, it's safe to call this method from multiple goroutines.
+//
+// Returned bindings MUST NOT be modified.
+func (self *Exchange) BindingsFor(consumer MessageConsumer) []*Binding {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	return self.bindingsFor(consumer)
+}
+
+func (self *Exchange) bindingsFor(consumer MessageConsumer) []*Binding {
+	var bindings []*Binding
+	for binding, bound := range self.consumers {
+		if bound == consumer {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	return bindings
+}
+
+// topologyMu guards exchange-to-exchange bindings.
+var topologyMu sync.Mutex
+
+// reaches reports whatever target is reachable from Exchange.
+func (self *Exchange) reaches(target *Exchange, visited map[*Exchange]struct{}) bool {
+	if self == target {
+		return true
+	}
+
+	if _, found := visited[self]; found {
+		return false
+	}
+	visited[self] = struct{}{}
+
+	var next []*Exchange
+	self.mu.RLock()
+	for _, consumer := range self.consumers {
+		if ex, ok := consumer.(*Exchange); ok {
+			next = append(next, ex)
+		}
+	}
+	if ex, ok := self.alternate.(*Exchange); ok {
+		next = append(next, ex)
+	}
+	self.mu.RUnlock()
+
+	for _, ex := range next {
+		if ex.reaches(target, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Ensure *Exchange implements Consumer interface
 var _ MessageConsumer = &Exchange{}
 
@@ -17,6 +17,7 @@ limitations under the License.
 package amq_test
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/canni/paperboymq/amq"
@@ -116,3 +117,274 @@ func TestExchange_OnlyOneDeliveryToSingleConsumer(t *testing.T) {
 		t.Errorf("Unexpected calls count: %d, expected: %d", c.callsCount, 100)
 	}
 }
+
+func TestExchange_PublishReportsRoutingResult(t *testing.T) {
+	ex := amq.NewExchange(matcher.Direct)
+
+	c1 := new(countingConsumer)
+	c2 := new(countingConsumer)
+
+	ex.BindTo(&amq.Binding{Key: "key", Consumer: c1})
+	ex.BindTo(&amq.Binding{Key: "key", Consumer: c1})
+	ex.BindTo(&amq.Binding{Key: "key", Consumer: c2})
+	ex.BindTo(&amq.Binding{Key: "other", Consumer: c2})
+
+	result := ex.Publish(testMsg{routingKey: "key"})
+	if result.Bindings != 3 || result.Consumers != 2 || !result.Routed() {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+
+	result = ex.Publish(testMsg{routingKey: "none"})
+	if result.Bindings != 0 || result.Consumers != 0 || result.Routed() {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+}
+
+func TestExchange_MandatoryUnroutableMessageIsReturned(t *testing.T) {
+	returns := make(messageConsumer, 1)
+	ex := amq.NewExchange(matcher.Direct, amq.ReturnTo(returns))
+
+	c := new(countingConsumer)
+	ex.BindTo(&amq.Binding{Key: "key", Consumer: c})
+
+	if result := ex.Publish(testMsg{routingKey: "key"}, amq.Mandatory()); result.Returned {
+		t.Error("Unexpected routed message returned")
+	}
+	returns.none(t)
+
+	if result := ex.Publish(testMsg{routingKey: "none"}); result.Returned {
+		t.Error("Unexpected non-mandatory message returned")
+	}
+	returns.none(t)
+
+	if result := ex.Publish(testMsg{routingKey: "none"}, amq.Mandatory()); !result.Returned {
+		t.Error("Expected unroutable message to be returned")
+	}
+
+	if msg := returns.next(t); msg.RoutingKey() != "none" {
+		t.Error("Unexpected message returned:", msg.RoutingKey())
+	}
+}
+
+func TestExchange_UnroutableMessageGoesToAlternateExchange(t *testing.T) {
+	c := new(countingConsumer)
+	alternate := amq.NewExchange(matcher.Fanout)
+	alternate.BindTo(&amq.Binding{Consumer: c})
+
+	returns := make(messageConsumer, 1)
+	ex := amq.NewExchange(
+		matcher.Topic,
+		amq.AlternateExchange(alternate),
+		amq.ReturnTo(returns),
+	)
+	ex.BindTo(&amq.Binding{Key: "orders.*", Consumer: new(countingConsumer)})
+
+	if result := ex.Publish(testMsg{routingKey: "orders.created"}); result.Alternate {
+		t.Error("Unexpected routed message passed to alternate exchange")
+	}
+
+	result := ex.Publish(testMsg{routingKey: "invoices.created"}, amq.Mandatory())
+	if !result.Alternate || !result.Routed() || result.Returned {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+
+	if c.callsCount != 1 {
+		t.Errorf("Unexpected calls count: %d, expected: %d", c.callsCount, 1)
+	}
+	returns.none(t)
+}
+
+func TestExchange_MessageUnroutableByAlternateExchangeIsReturned(t *testing.T) {
+	returns := make(messageConsumer, 1)
+	ex := amq.NewExchange(
+		matcher.Direct,
+		amq.AlternateExchange(amq.NewExchange(matcher.Direct)),
+		amq.ReturnTo(returns),
+	)
+
+	result := ex.Publish(testMsg{routingKey: "none"}, amq.Mandatory())
+	if !result.Alternate || result.Routed() || !result.Returned {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+	returns.next(t)
+}
+
+func TestExchange_SelectingMatcherDeliversToSingleBinding(t *testing.T) {
+	ex := amq.NewExchange(matcher.ConsistentHash)
+
+	if err := ex.BindTo(&amq.Binding{Key: "weight", Consumer: new(countingConsumer)}); err != matcher.ErrInvalidWeight {
+		t.Error("Unexpected error:", err)
+	}
+
+	c1 := new(countingConsumer)
+	c2 := new(countingConsumer)
+	b1 := &amq.Binding{Key: "1", Consumer: c1}
+	ex.BindTo(b1)
+	ex.BindTo(&amq.Binding{Key: "1", Consumer: c2})
+
+	for i := 0; i < 100; i++ {
+		result := ex.Publish(testMsg{routingKey: strconv.Itoa(i)})
+		if result.Bindings != 1 || result.Consumers != 1 {
+			t.Fatalf("Unexpected publish result: %+v", result)
+		}
+	}
+
+	if c1.callsCount+c2.callsCount != 100 {
+		t.Errorf("Unexpected calls count: %d, expected: %d", c1.callsCount+c2.callsCount, 100)
+	}
+
+	ex.UnbindFrom(b1)
+	for i := 0; i < 100; i++ {
+		ex.Consume(testMsg{routingKey: strconv.Itoa(i)})
+	}
+
+	if c2.callsCount < 100 {
+		t.Errorf("Unexpected calls count: %d, expected at least: %d", c2.callsCount, 100)
+	}
+}
+
+func TestExchange_UnboundBindingIsRemovedFromIndex(t *testing.T) {
+	ex := amq.NewExchange(matcher.Direct)
+
+	c1 := new(countingConsumer)
+	c2 := new(countingConsumer)
+	b1 := &amq.Binding{Key: "key", Consumer: c1}
+
+	ex.BindTo(b1)
+	ex.BindTo(&amq.Binding{Key: "key", Consumer: c2})
+	ex.UnbindFrom(b1)
+
+	if result := ex.Publish(testMsg{routingKey: "key"}); result.Bindings != 1 {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+
+	if c1.callsCount != 0 || c2.callsCount != 1 {
+		t.Errorf("Unexpected calls counts: %d, %d", c1.callsCount, c2.callsCount)
+	}
+}
+
+func BenchmarkExchange_DirectRouting(b *testing.B) {
+	ex := amq.NewExchange(matcher.Direct)
+	for i := 0; i < 5000; i++ {
+		ex.BindTo(&amq.Binding{Key: strconv.Itoa(i), Consumer: new(countingConsumer)})
+	}
+
+	msg := testMsg{routingKey: "2500"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ex.Consume(msg)
+	}
+}
+
+func TestExchange_BindToRejectsCycles(t *testing.T) {
+	a := amq.NewExchange(matcher.Fanout)
+	b := amq.NewExchange(matcher.Fanout)
+	c := amq.NewExchange(matcher.Fanout, amq.AlternateExchange(a))
+
+	if err := a.BindTo(&amq.Binding{Consumer: a}); err != amq.ErrBindingCycle {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := a.BindTo(&amq.Binding{Consumer: b}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := b.BindTo(&amq.Binding{Consumer: a}); err != amq.ErrBindingCycle {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := b.BindTo(&amq.Binding{Consumer: c}); err != amq.ErrBindingCycle {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := c.BindTo(&amq.Binding{Consumer: b}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestExchange_DeliversOnceAcrossExchangeGraph(t *testing.T) {
+	top := amq.NewExchange(matcher.Fanout)
+	left := amq.NewExchange(matcher.Direct)
+	right := amq.NewExchange(matcher.Topic)
+	bottom := amq.NewExchange(matcher.Fanout)
+
+	q := new(countingConsumer)
+	other := new(countingConsumer)
+
+	top.BindTo(&amq.Binding{Consumer: left})
+	top.BindTo(&amq.Binding{Consumer: right})
+	left.BindTo(&amq.Binding{Key: "key", Consumer: q})
+	left.BindTo(&amq.Binding{Key: "key", Consumer: bottom})
+	right.BindTo(&amq.Binding{Key: "#", Consumer: q})
+	right.BindTo(&amq.Binding{Key: "#", Consumer: bottom})
+	bottom.BindTo(&amq.Binding{Consumer: q})
+	bottom.BindTo(&amq.Binding{Consumer: other})
+
+	result := top.Publish(testMsg{routingKey: "key"})
+
+	if q.callsCount != 1 || other.callsCount != 1 {
+		t.Errorf("Unexpected calls counts: %d, %d", q.callsCount, other.callsCount)
+	}
+
+	if result.Consumers != 2 {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+}
+
+func TestExchange_BindingsIntrospection(t *testing.T) {
+	ex := amq.NewExchange(matcher.Headers)
+
+	c1 := new(countingConsumer)
+	c2 := new(countingConsumer)
+
+	b1 := &amq.Binding{Arguments: amq.Headers{"format": "pdf"}, Consumer: c1}
+	b2 := &amq.Binding{Arguments: amq.Headers{"format": "zip"}, Consumer: c1}
+	b3 := &amq.Binding{Arguments: amq.Headers{"x-match": "any"}, Consumer: c2}
+
+	if bindings := ex.Bindings(); len(bindings) != 0 {
+		t.Error("Unexpected bindings:", bindings)
+	}
+
+	ex.BindTo(b1)
+	ex.BindTo(b2)
+	ex.BindTo(b3)
+
+	if bindings := ex.Bindings(); len(bindings) != 3 {
+		t.Errorf("Unexpected number of bindings %d, expected %d", len(bindings), 3)
+	}
+
+	if bindings := ex.BindingsFor(c2); len(bindings) != 1 || bindings[0] != b3 {
+		t.Error("Unexpected bindings:", bindings)
+	}
+
+	if bindings := ex.UnbindConsumer(c1); len(bindings) != 2 {
+		t.Errorf("Unexpected number of unbound bindings %d, expected %d", len(bindings), 2)
+	}
+
+	if bindings := ex.BindingsFor(c1); len(bindings) != 0 {
+		t.Error("Unexpected bindings:", bindings)
+	}
+
+	if err := ex.UnbindFrom(b1); err != amq.ErrBindingNotFound {
+		t.Error("Unexpected error:", err)
+	}
+
+	ex.Consume(testMsg{headers: amq.Headers{"format": "pdf"}})
+	if c1.callsCount != 0 {
+		t.Errorf("Unexpected calls count: %d, expected: %d", c1.callsCount, 0)
+	}
+}
+
+func TestExchange_UnbindConsumerRemovesIndexedBindings(t *testing.T) {
+	ex := amq.NewExchange(matcher.Topic)
+
+	c := new(countingConsumer)
+	ex.BindTo(&amq.Binding{Key: "a.*", Consumer: c})
+	ex.BindTo(&amq.Binding{Key: "#", Consumer: c})
+	ex.UnbindConsumer(c)
+
+	if result := ex.Publish(testMsg{routingKey: "a.b"}); result.Bindings != 0 {
+		t.Errorf("Unexpected publish result: %+v", result)
+	}
+}
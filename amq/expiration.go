@@ -0,0 +1,126 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"strconv"
+	"time"
+)
+
+// expirySweepInterval is a period of ExpiringQueueHandler.RemoveExpired() calls.
+const expirySweepInterval = time.Second
+
+// ExpiringMessage is an interface implemented by messages held in Queue
+// with expiration deadline, zero deadline means message never expires.
+type ExpiringMessage interface {
+	ExpiresAt() time.Time
+}
+
+// ExpiringQueueHandler is an interface implemented by QueueHandlers capable
+// of removing expired messages held anywhere in the queue, not only at its
+// head, Queue calls RemoveExpired() periodically.
+type ExpiringQueueHandler interface {
+	QueueHandler
+	RemoveExpired(now time.Time) []Message
+}
+
+// Expired reports whatever message deadline passed at given time.
+func Expired(msg Message, now time.Time) bool {
+	if e, ok := msg.(ExpiringMessage); ok {
+		deadline := e.ExpiresAt()
+		return !deadline.IsZero() && !now.Before(deadline)
+	}
+
+	return false
+}
+
+// MessageTTL sets time after which messages held in Queue expire,
+// like x-message-ttl queue argument. Per-message expiration property
+// is honoured regardless of this option, the shorter one wins.
+func MessageTTL(ttl time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.ttl = ttl
+	}
+}
+
+// messageTTL returns TTL for message, based on queue TTL and message
+// expiration property (in milliseconds), zero duration means no TTL.
+func (self *Queue) messageTTL(msg Message) (time.Duration, bool) {
+	ttl, found := self.ttl, self.ttl > 0
+
+	if exp := PropertiesOf(msg).Expiration; exp != "" {
+		if ms, err := strconv.ParseUint(exp, 10, 32); err == nil {
+			if d := time.Duration(ms) * time.Millisecond; !found || d < ttl {
+				ttl, found = d, true
+			}
+		}
+	}
+
+	return ttl, found
+}
+
+// hold wraps message arrived at given time with metadata used by Queue,
+// if it needs any.
+//
+// Due time of delayed message is fixed on arrival, TTL of delayed message is
+// counted from the time it's due.
+func (self *Queue) hold(msg Message, now time.Time) Message {
+	notBefore := NotBefore(msg, now)
+	msg = unwrapDue(msg)
+
+	if ttl, found := self.messageTTL(msg); found {
+		due := now
+		if notBefore.After(now) {
+			due = notBefore
+		}
+
+		return &heldMessage{
+			Message:   msg,
+			expiresAt: due.Add(ttl),
+			notBefore: notBefore,
+		}
+	}
+
+	if notBefore.After(now) {
+		return &heldMessage{
+			Message:   msg,
+			notBefore: notBefore,
+		}
+	}
+
+	return msg
+}
+
+// dropExpired removes expired messages from the head of handler.
+func (self *Queue) dropExpired(now time.Time) {
+	for self.handler.Len() > 0 && Expired(self.handler.Peek(), now) {
+		self.deadLetter(DeadLetterExpired, self.remove())
+	}
+}
+
+// nextExpiration returns channel signaled when message at the head of handler
+// expires, or nil channel if it never expires.
+func (self *Queue) nextExpiration(now time.Time) (<-chan time.Time, func() bool) {
+	if self.handler.Len() > 0 {
+		if e, ok := self.handler.Peek().(ExpiringMessage); ok && !e.ExpiresAt().IsZero() {
+			timer := time.NewTimer(e.ExpiresAt().Sub(now))
+			return timer.C, timer.Stop
+		}
+	}
+
+	return nil, func() bool { return false }
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"time"
+)
+
+// Delivery modes as defined by AMQP basic.properties.
+const (
+	Transient  uint8 = 1
+	Persistent uint8 = 2
+)
+
+// BasicProperties is an interface representing AMQP basic properties carried
+// by a Message.
+//
+// Messages are not required to implement this interface, entities within this
+// package use type assertion to check for properties support and fall back to
+// zero values otherwise.
+type BasicProperties interface {
+	ContentType() string
+	ContentEncoding() string
+	DeliveryMode() uint8
+	CorrelationId() string
+	ReplyTo() string
+	Expiration() string
+	MessageId() string
+	Type() string
+	UserId() string
+	AppId() string
+}
+
+// PropertiesOf returns AMQP basic properties of message, or zero value
+// Properties if message does not implement BasicProperties interface.
+//
+// Messages wrapped by this package (like Delivery) are unwrapped first.
+func PropertiesOf(msg Message) Properties {
+	for {
+		if w, ok := msg.(messageWrapper); ok {
+			msg = w.unwrap()
+		} else {
+			break
+		}
+	}
+
+	if props, ok := msg.(BasicProperties); ok {
+		return Properties{
+			ContentType:     props.ContentType(),
+			ContentEncoding: props.ContentEncoding(),
+			DeliveryMode:    props.DeliveryMode(),
+			CorrelationId:   props.CorrelationId(),
+			ReplyTo:         props.ReplyTo(),
+			Expiration:      props.Expiration(),
+			MessageId:       props.MessageId(),
+			Type:            props.Type(),
+			UserId:          props.UserId(),
+			AppId:           props.AppId(),
+		}
+	}
+
+	return Properties{}
+}
+
+// Properties is a plain value holding AMQP basic properties.
+type Properties struct {
+	ContentType     string
+	ContentEncoding string
+	DeliveryMode    uint8
+	CorrelationId   string
+	ReplyTo         string
+	Expiration      string
+	MessageId       string
+	Type            string
+	UserId          string
+	AppId           string
+}
+
+// BasicMessage is an immutable Message implementation carrying AMQP basic
+// properties, it needs to be created by MessageBuilder.
+//
+// Values returned by Headers() and Body() are shared between all callers and
+// MUST NOT be modified.
+type BasicMessage struct {
+	headers    Headers
+	routingKey string
+	priority   uint8
+	timestamp  time.Time
+	body       []byte
+	props      Properties
+}
+
+func (self *BasicMessage) Headers() Headers {
+	return self.headers
+}
+
+func (self *BasicMessage) RoutingKey() string {
+	return self.routingKey
+}
+
+func (self *BasicMessage) Priority() uint8 {
+	return self.priority
+}
+
+func (self *BasicMessage) Timestamp() time.Time {
+	return self.timestamp
+}
+
+func (self *BasicMessage) Body() []byte {
+	return self.body
+}
+
+func (self *BasicMessage) Properties() Properties {
+	return self.props
+}
+
+func (self *BasicMessage) ContentType() string {
+	return self.props.ContentType
+}
+
+func (self *BasicMessage) ContentEncoding() string {
+	return self.props.ContentEncoding
+}
+
+func (self *BasicMessage) DeliveryMode() uint8 {
+	return self.props.DeliveryMode
+}
+
+func (self *BasicMessage) CorrelationId() string {
+	return self.props.CorrelationId
+}
+
+func (self *BasicMessage) ReplyTo() string {
+	return self.props.ReplyTo
+}
+
+func (self *BasicMessage) Expiration() string {
+	return self.props.Expiration
+}
+
+func (self *BasicMessage) MessageId() string {
+	return self.props.MessageId
+}
+
+func (self *BasicMessage) Type() string {
+	return self.props.Type
+}
+
+func (self *BasicMessage) UserId() string {
+	return self.props.UserId
+}
+
+func (self *BasicMessage) AppId() string {
+	return self.props.AppId
+}
+
+// MessageBuilder builds immutable BasicMessage instances, it is not
+// goroutine-safe.
+//
+// Builder may be reused, every Build() call returns independent message.
+type MessageBuilder struct {
+	msg BasicMessage
+}
+
+// NewMessageBuilder returns empty MessageBuilder.
+func NewMessageBuilder() *MessageBuilder {
+	return &MessageBuilder{}
+}
+
+// MessageBuilderFrom returns MessageBuilder initialized with all attributes
+// of msg, including AMQP basic properties when msg implements BasicProperties.
+func MessageBuilderFrom(msg Message) *MessageBuilder {
+	return &MessageBuilder{
+		msg: BasicMessage{
+			headers:    msg.Headers(),
+			routingKey: msg.RoutingKey(),
+			priority:   msg.Priority(),
+			timestamp:  msg.Timestamp(),
+			body:       msg.Body(),
+			props:      PropertiesOf(msg),
+		},
+	}
+}
+
+func (self *MessageBuilder) Headers(headers Headers) *MessageBuilder {
+	self.msg.headers = headers
+	return self
+}
+
+// Header sets single header value, leaving other headers untouched.
+func (self *MessageBuilder) Header(name string, value interface{}) *MessageBuilder {
+	headers := make(Headers, len(self.msg.headers)+1)
+	for k, v := range self.msg.headers {
+		headers[k] = v
+	}
+	headers[name] = value
+
+	self.msg.headers = headers
+	return self
+}
+
+func (self *MessageBuilder) RoutingKey(key string) *MessageBuilder {
+	self.msg.routingKey = key
+	return self
+}
+
+func (self *MessageBuilder) Priority(priority uint8) *MessageBuilder {
+	self.msg.priority = priority
+	return self
+}
+
+func (self *MessageBuilder) Timestamp(timestamp time.Time) *MessageBuilder {
+	self.msg.timestamp = timestamp
+	return self
+}
+
+func (self *MessageBuilder) Body(body []byte) *MessageBuilder {
+	self.msg.body = body
+	return self
+}
+
+func (self *MessageBuilder) Properties(props Properties) *MessageBuilder {
+	self.msg.props = props
+	return self
+}
+
+func (self *MessageBuilder) ContentType(contentType string) *MessageBuilder {
+	self.msg.props.ContentType = contentType
+	return self
+}
+
+func (self *MessageBuilder) ContentEncoding(contentEncoding string) *MessageBuilder {
+	self.msg.props.ContentEncoding = contentEncoding
+	return self
+}
+
+func (self *MessageBuilder) DeliveryMode(mode uint8) *MessageBuilder {
+	self.msg.props.DeliveryMode = mode
+	return self
+}
+
+func (self *MessageBuilder) CorrelationId(id string) *MessageBuilder {
+	self.msg.props.CorrelationId = id
+	return self
+}
+
+func (self *MessageBuilder) ReplyTo(replyTo string) *MessageBuilder {
+	self.msg.props.ReplyTo = replyTo
+	return self
+}
+
+func (self *MessageBuilder) Expiration(expiration string) *MessageBuilder {
+	self.msg.props.Expiration = expiration
+	return self
+}
+
+func (self *MessageBuilder) MessageId(id string) *MessageBuilder {
+	self.msg.props.MessageId = id
+	return self
+}
+
+func (self *MessageBuilder) Type(typ string) *MessageBuilder {
+	self.msg.props.Type = typ
+	return self
+}
+
+func (self *MessageBuilder) UserId(id string) *MessageBuilder {
+	self.msg.props.UserId = id
+	return self
+}
+
+func (self *MessageBuilder) AppId(id string) *MessageBuilder {
+	self.msg.props.AppId = id
+	return self
+}
+
+// Build returns new BasicMessage, headers and body are copied so further
+// modifications of values passed to builder do not affect built message.
+//
+// If timestamp was not set, current time is used.
+func (self *MessageBuilder) Build() *BasicMessage {
+	msg := self.msg
+
+	if msg.headers != nil {
+		msg.headers = make(Headers, len(self.msg.headers))
+		for k, v := range self.msg.headers {
+			msg.headers[k] = v
+		}
+	}
+
+	if msg.body != nil {
+		msg.body = append([]byte(nil), self.msg.body...)
+	}
+
+	if msg.timestamp.IsZero() {
+		msg.timestamp = time.Now()
+	}
+
+	return &msg
+}
+
+// Ensure *BasicMessage implements Message interface
+var _ Message = &BasicMessage{}
+
+// Ensure *BasicMessage implements BasicProperties interface
+var _ BasicProperties = &BasicMessage{}
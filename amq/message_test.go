@@ -0,0 +1,166 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+func TestMessageBuilder_BuildsMessageWithAllAttributes(t *testing.T) {
+	ts := time.Now().Add(-time.Hour)
+
+	msg := amq.NewMessageBuilder().
+		Headers(amq.Headers{"h": 1}).
+		RoutingKey("key").
+		Priority(5).
+		Timestamp(ts).
+		Body([]byte("body")).
+		ContentType("text/plain").
+		ContentEncoding("utf-8").
+		DeliveryMode(amq.Persistent).
+		CorrelationId("correlation").
+		ReplyTo("reply").
+		Expiration("1000").
+		MessageId("id").
+		Type("type").
+		UserId("user").
+		AppId("app").
+		Build()
+
+	if msg.Headers()["h"] != 1 {
+		t.Error("Unexpected headers:", msg.Headers())
+	}
+	if msg.RoutingKey() != "key" {
+		t.Error("Unexpected routing key:", msg.RoutingKey())
+	}
+	if msg.Priority() != 5 {
+		t.Error("Unexpected priority:", msg.Priority())
+	}
+	if msg.Timestamp() != ts {
+		t.Error("Unexpected timestamp:", msg.Timestamp())
+	}
+	if !bytes.Equal(msg.Body(), []byte("body")) {
+		t.Error("Unexpected body:", msg.Body())
+	}
+
+	expected := amq.Properties{
+		ContentType:     "text/plain",
+		ContentEncoding: "utf-8",
+		DeliveryMode:    amq.Persistent,
+		CorrelationId:   "correlation",
+		ReplyTo:         "reply",
+		Expiration:      "1000",
+		MessageId:       "id",
+		Type:            "type",
+		UserId:          "user",
+		AppId:           "app",
+	}
+	if msg.Properties() != expected {
+		t.Errorf("Unexpected properties: %+v", msg.Properties())
+	}
+	if amq.PropertiesOf(msg) != expected {
+		t.Errorf("Unexpected properties: %+v", amq.PropertiesOf(msg))
+	}
+}
+
+func TestMessageBuilder_BuiltMessageIsNotAffectedByBuilderInputs(t *testing.T) {
+	headers := amq.Headers{"h": 1}
+	body := []byte("body")
+
+	b := amq.NewMessageBuilder().Headers(headers).Body(body)
+	msg := b.Build()
+
+	headers["h"] = 2
+	body[0] = 'B'
+	b.RoutingKey("other")
+
+	if msg.Headers()["h"] != 1 {
+		t.Error("Message headers were modified")
+	}
+	if string(msg.Body()) != "body" {
+		t.Error("Message body was modified")
+	}
+	if msg.RoutingKey() != "" {
+		t.Error("Message routing key was modified")
+	}
+}
+
+func TestMessageBuilder_SetsTimestampWhenMissing(t *testing.T) {
+	before := time.Now()
+	msg := amq.NewMessageBuilder().Build()
+
+	if msg.Timestamp().Before(before) {
+		t.Error("Unexpected timestamp:", msg.Timestamp())
+	}
+}
+
+func TestMessageBuilder_HeaderDoesNotModifyPreviousMessage(t *testing.T) {
+	b := amq.NewMessageBuilder().Header("a", 1)
+	first := b.Build()
+	second := b.Header("b", 2).Build()
+
+	if len(first.Headers()) != 1 {
+		t.Error("Unexpected headers:", first.Headers())
+	}
+	if len(second.Headers()) != 2 || second.Headers()["a"] != 1 {
+		t.Error("Unexpected headers:", second.Headers())
+	}
+}
+
+func TestMessageBuilder_FromCopiesMessage(t *testing.T) {
+	ts := time.Now()
+	orig := amq.NewMessageBuilder().
+		RoutingKey("key").
+		Priority(3).
+		Timestamp(ts).
+		MessageId("id").
+		DeliveryMode(amq.Persistent).
+		Build()
+
+	msg := amq.MessageBuilderFrom(orig).Header("x", "y").Build()
+
+	if msg.RoutingKey() != "key" || msg.Priority() != 3 || msg.Timestamp() != ts {
+		t.Error("Message attributes were not copied")
+	}
+	if msg.MessageId() != "id" || msg.DeliveryMode() != amq.Persistent {
+		t.Error("Message properties were not copied")
+	}
+	if orig.Headers() != nil {
+		t.Error("Original message was modified")
+	}
+}
+
+func TestMessageBuilder_FromPlainMessage(t *testing.T) {
+	msg := amq.MessageBuilderFrom(testMsg{routingKey: "key"}).Build()
+
+	if msg.RoutingKey() != "key" {
+		t.Error("Unexpected routing key:", msg.RoutingKey())
+	}
+	if msg.Properties() != (amq.Properties{}) {
+		t.Errorf("Unexpected properties: %+v", msg.Properties())
+	}
+}
+
+func TestPropertiesOf_PlainMessageHasZeroProperties(t *testing.T) {
+	if amq.PropertiesOf(testMsg{}) != (amq.Properties{}) {
+		t.Error("Unexpected non-zero properties")
+	}
+}
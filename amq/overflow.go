@@ -0,0 +1,111 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrQueueFull = errors.New("Queue: Queue full")
+)
+
+// OverflowPolicy defines Queue behaviour when its length limits are reached.
+type OverflowPolicy int
+
+const (
+	// OverflowDropHead drops (or dead-letters) messages from the head of Queue
+	// to make room for new ones.
+	OverflowDropHead OverflowPolicy = iota
+
+	// OverflowRejectPublish drops new messages, publishers are notified
+	// with ErrQueueFull.
+	OverflowRejectPublish
+
+	// OverflowRejectPublishDLX is like OverflowRejectPublish, but rejected
+	// messages are dead-lettered.
+	OverflowRejectPublishDLX
+)
+
+// MaxLength limits number of messages held in Queue, like x-max-length queue
+// argument, zero means no limit.
+func MaxLength(length int) QueueOption {
+	return func(q *Queue) {
+		q.maxLength = length
+	}
+}
+
+// MaxLengthBytes limits total body size of messages held in Queue, like
+// x-max-length-bytes queue argument, zero means no limit.
+func MaxLengthBytes(size int) QueueOption {
+	return func(q *Queue) {
+		q.maxLengthBytes = size
+	}
+}
+
+// Overflow sets Queue behaviour when its length limits are reached, like
+// x-overflow queue argument, default policy is OverflowDropHead.
+func Overflow(policy OverflowPolicy) QueueOption {
+	return func(q *Queue) {
+		q.overflow = policy
+	}
+}
+
+// enqueue adds message to handler, enforcing length limits with given
+// overflow policy.
+func (self *Queue) enqueue(msg Message, overflow OverflowPolicy, now time.Time) error {
+	if overflow != OverflowDropHead && self.exceedsLimits(msg) {
+		if overflow == OverflowRejectPublishDLX {
+			self.deadLetter(DeadLetterMaxLen, msg)
+		}
+
+		return ErrQueueFull
+	}
+
+	if err := self.add(self.hold(msg, now)); err != nil {
+		return err
+	}
+	self.dropOverLimits()
+
+	return nil
+}
+
+// dropOverLimits dead-letters messages from the head of queue, until it's
+// within length limits.
+func (self *Queue) dropOverLimits() {
+	for self.handler.Len() > 0 && self.overLimits() {
+		self.deadLetter(DeadLetterMaxLen, self.remove())
+	}
+}
+
+// exceedsLimits reports whatever adding message would exceed length limits.
+func (self *Queue) exceedsLimits(msg Message) bool {
+	if self.maxLength > 0 && self.handler.Len() >= self.maxLength {
+		return true
+	}
+
+	return self.maxLengthBytes > 0 && self.bytes+len(msg.Body()) > self.maxLengthBytes
+}
+
+func (self *Queue) overLimits() bool {
+	if self.maxLength > 0 && self.handler.Len() > self.maxLength {
+		return true
+	}
+
+	return self.maxLengthBytes > 0 && self.bytes > self.maxLengthBytes
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/canni/paperboymq/amq"
+	"github.com/canni/paperboymq/queue"
+)
+
+func TestOverflow_DropHeadByDefault(t *testing.T) {
+	dlx := make(messageConsumer, 2)
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.MaxLength(3),
+		amq.DeadLetterExchange(dlx, ""),
+	)
+	defer q.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := q.Publish(testMsg{routingKey: strconv.Itoa(i)}); err != nil {
+			t.Error("Unexpected error:", err)
+		}
+	}
+
+	if q.Len() != 3 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 3)
+	}
+
+	for i := 0; i < 2; i++ {
+		msg := dlx.next(t)
+		if msg.RoutingKey() != strconv.Itoa(i) {
+			t.Error("Unexpected message dead-lettered:", msg.RoutingKey())
+		}
+		if death := xDeath(t, msg, 0); death["reason"] != amq.DeadLetterMaxLen {
+			t.Error("Unexpected x-death entry:", death)
+		}
+	}
+
+	c := make(deliveryConsumer, 3)
+	q.Subscribe(c)
+
+	if msg := c.next(t); msg.RoutingKey() != "2" {
+		t.Error("Unexpected message delivered:", msg.RoutingKey())
+	}
+}
+
+func TestOverflow_RejectPublish(t *testing.T) {
+	dlx := make(messageConsumer, 1)
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.MaxLength(2),
+		amq.Overflow(amq.OverflowRejectPublish),
+		amq.DeadLetterExchange(dlx, ""),
+	)
+	defer q.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := q.Publish(testMsg{}); err != nil {
+			t.Error("Unexpected error:", err)
+		}
+	}
+
+	if err := q.Publish(testMsg{}); err != amq.ErrQueueFull {
+		t.Error("Unexpected error:", err)
+	}
+
+	q.Consume(testMsg{})
+
+	if q.Len() != 2 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 2)
+	}
+	dlx.none(t)
+}
+
+func TestOverflow_RejectPublishDLX(t *testing.T) {
+	dlx := make(messageConsumer, 1)
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.MaxLength(1),
+		amq.Overflow(amq.OverflowRejectPublishDLX),
+		amq.DeadLetterExchange(dlx, ""),
+	)
+	defer q.Close()
+
+	q.Publish(testMsg{routingKey: "first"})
+
+	if err := q.Publish(testMsg{routingKey: "second"}); err != amq.ErrQueueFull {
+		t.Error("Unexpected error:", err)
+	}
+
+	if msg := dlx.next(t); msg.RoutingKey() != "second" {
+		t.Error("Unexpected message dead-lettered:", msg.RoutingKey())
+	}
+}
+
+func TestOverflow_MaxLengthBytes(t *testing.T) {
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.MaxLengthBytes(10),
+		amq.Overflow(amq.OverflowRejectPublish),
+	)
+	defer q.Close()
+
+	if err := q.Publish(testMsg{body: make([]byte, 6)}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := q.Publish(testMsg{body: make([]byte, 6)}); err != amq.ErrQueueFull {
+		t.Error("Unexpected error:", err)
+	}
+	if err := q.Publish(testMsg{body: make([]byte, 4)}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	c := make(deliveryConsumer, 2)
+	q.Subscribe(c)
+	c.next(t)
+	c.next(t)
+
+	if err := q.Publish(testMsg{body: make([]byte, 10)}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestOverflow_MaxLengthBytesDropHead(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.MaxLengthBytes(10))
+	defer q.Close()
+
+	for i := 0; i < 4; i++ {
+		q.Consume(testMsg{body: make([]byte, 4)})
+	}
+
+	if q.Len() != 2 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 2)
+	}
+}
@@ -16,6 +16,12 @@ limitations under the License.
 
 package amq
 
+import (
+	"context"
+	"sync"
+	"time"
+)
+
 // QueueHandler is an interface used by Queue implementation for internal
 // queueing of messages, implementors does not need to worry about concurrent
 // access.
@@ -31,41 +37,212 @@ type QueueHandler interface {
 // Queue needs to be initialized by calling NewQueue()
 //
 // Queue delivers messages to subscribed MessageConsumers in a round-robin
-// fashion. Queue MUST be closed after use, either by calling Close()
-// witch will flush all held messages to subscibed consumers (if any),
-// or by calling ForceClose(), witch will drop messages and exit immediately.
+// fashion (see DispatchStrategy() for other strategies), consumers which
+// reached their prefetch limits are skipped. Every
+// consumer is called from its own goroutine with bounded delivery buffer,
+// consumers with full buffers are skipped too. Consumers with higher priority
+// are preferred, see ConsumerPriority(). In single active consumer mode only
+// one consumer receives messages, see SingleActiveConsumer().
+// Queue MUST be closed after use, either by calling Close() witch will flush
+// all held messages to subscibed consumers (if any), or by calling
+// ForceClose(), witch will drop messages and exit immediately.
+//
+// Messages are passed to consumers wrapped in *Delivery, see SubscribeWith()
+// for acknowledgement support.
 type Queue struct {
-	input, output chan Message
+	input         chan Message
+	output        chan *takenMessage
+	publish       chan *publishOp
+	get           chan chan getResult
+	purge         chan chan int
+	browse        chan *browseOp
 	subscribeOp   chan *subscriptionOp
 	subscriptions chan []MessageConsumer
 	lenght        chan int
+	returned      chan struct{}
+	capacity      chan struct{}
+	deadLettered  chan struct{}
 	quit, quitCnf chan bool
+	closing       chan struct{}
+	done          chan struct{}
 	handler       QueueHandler
+	name          string
+	ttl           time.Duration
+	dlx           MessageConsumer
+	dlxRoutingKey string
+
+	maxLength      int
+	maxLengthBytes int
+	overflow       OverflowPolicy
+
+	singleActive  bool
+	newDispatcher func() Dispatcher
+
+	// bytes is total body size of held messages, owned by inputHandler
+	bytes int
+
+	// mu guards fields below, which are shared with Delivery settlements
+	mu          sync.Mutex
+	returns     []*takenMessage
+	settled     []uint64
+	deadLetters []deadLetter
+	deliveryTag uint64
+	closed      bool
 }
 
-// NewQueue returns initialized Queue.
-func NewQueue(handler QueueHandler) *Queue {
+// QueueOption configures Queue, see NewQueue().
+type QueueOption func(*Queue)
+
+// NewQueue returns initialized Queue, configured with given options.
+//
+// Messages already held by handler, like ones recovered by durable handler,
+// are delivered as usual.
+func NewQueue(handler QueueHandler, opts ...QueueOption) *Queue {
 	q := &Queue{
 		input:         make(chan Message),
-		output:        make(chan Message),
+		output:        make(chan *takenMessage),
+		publish:       make(chan *publishOp),
+		get:           make(chan chan getResult),
+		purge:         make(chan chan int),
+		browse:        make(chan *browseOp),
 		subscribeOp:   make(chan *subscriptionOp),
 		subscriptions: make(chan []MessageConsumer),
 		lenght:        make(chan int),
+		returned:      make(chan struct{}, 1),
+		capacity:      make(chan struct{}, 1),
+		deadLettered:  make(chan struct{}, 1),
 		quit:          make(chan bool),
 		quitCnf:       make(chan bool),
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
 		handler:       handler,
+		newDispatcher: NewRoundRobinDispatcher,
+	}
+
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	// Handler may already hold messages, like durable handler recovered
+	// after restart, only visible ones are counted, they're iterated first
+	if iterable, ok := handler.(IterableQueueHandler); ok {
+		visible := handler.Len()
+		iterable.Iterate(func(msg Message) bool {
+			if visible == 0 {
+				return false
+			}
+
+			visible--
+			q.bytes += len(msg.Body())
+			return true
+		})
 	}
 
 	go q.inputHandler()
 	go q.outputHandler()
 
+	if q.dlx != nil {
+		go q.deadLetterHandler()
+	}
+
 	return q
 }
 
+// QueueName sets name identifying Queue, it's used in x-death headers of
+// dead-lettered messages.
+func QueueName(name string) QueueOption {
+	return func(q *Queue) {
+		q.name = name
+	}
+}
+
+// Name returns name of Queue.
+func (self *Queue) Name() string {
+	return self.name
+}
+
 // Consume enqueues message in Queue, it's safe to call this method from
 // multiple goroutines.
+//
+// Deliveries received from another Queue are unwrapped, so only the original
+// message is enqueued.
+//
+// Messages rejected due to Queue length limits or by handler, or consumed
+// after Queue was closed are silently dropped, use Publish() to get notified.
 func (self *Queue) Consume(msg Message) {
-	self.input <- msg
+	select {
+	case self.input <- unwrapDelivery(msg):
+	case <-self.closing:
+	}
+}
+
+// Publish enqueues message like Consume() does, and reports whatever Queue
+// accepted it, it's safe to call this method from multiple goroutines.
+//
+// If Queue length limits are reached and reject-publish overflow policy is
+// used the returned error will be of type: ErrQueueFull
+//
+// If Queue is closed the returned error will be of type: ErrQueueClosed,
+// errors of CheckedQueueHandler are returned as they are.
+func (self *Queue) Publish(msg Message) error {
+	return self.ConsumeContext(context.Background(), msg)
+}
+
+// ConsumeContext enqueues message like Publish() does, but gives up when
+// context is done before Queue accepts message, it's safe to call this method
+// from multiple goroutines.
+//
+// If context is done first the returned error is the one of ctx.Err(),
+// see Publish() for other errors.
+func (self *Queue) ConsumeContext(ctx context.Context, msg Message) error {
+	return self.sendPublishOp(ctx, unwrapDelivery(msg), self.overflow)
+}
+
+// TryConsume enqueues message only if Queue has room for it, it never drops
+// held messages to make room, regardless of overflow policy. It's safe to call
+// this method from multiple goroutines.
+//
+// If Queue length limits are reached the returned error will be of type:
+// ErrQueueFull, reject-publish-dlx overflow policy still dead-letters message.
+//
+// If Queue is closed the returned error will be of type: ErrQueueClosed
+func (self *Queue) TryConsume(msg Message) error {
+	overflow := self.overflow
+	if overflow == OverflowDropHead {
+		overflow = OverflowRejectPublish
+	}
+
+	return self.sendPublishOp(context.Background(), unwrapDelivery(msg), overflow)
+}
+
+// sendPublishOp passes message to inputHandler, waiting until it's accepted
+// or context is done.
+func (self *Queue) sendPublishOp(ctx context.Context, msg Message, overflow OverflowPolicy) error {
+	// Checked upfront, so closed Queue is reported even with done context
+	select {
+	case <-self.closing:
+		return ErrQueueClosed
+	default:
+	}
+
+	result := make(chan error, 1)
+	op := &publishOp{
+		msg:      msg,
+		overflow: overflow,
+		result:   result,
+	}
+
+	select {
+	case self.publish <- op:
+		// inputHandler replies immediately
+		return <-result
+
+	case <-self.closing:
+		return ErrQueueClosed
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Subscribe new consumer in a round-robin ring, it's safe to call this method
@@ -74,10 +251,20 @@ func (self *Queue) Consume(msg Message) {
 // If consumer is already subscribed the returned error will be of type:
 // ErrConsumerAlreadySubscribed
 func (self *Queue) Subscribe(consumer MessageConsumer) error {
+	return self.SubscribeWith(consumer)
+}
+
+// SubscribeWith subscribes new consumer in a round-robin ring, configured
+// with given options, it's safe to call this method from multiple goroutines.
+//
+// If consumer is already subscribed the returned error will be of type:
+// ErrConsumerAlreadySubscribed
+func (self *Queue) SubscribeWith(consumer MessageConsumer, opts ...SubscribeOption) error {
 	result := make(chan error)
 	self.subscribeOp <- &subscriptionOp{
 		subscribe: true,
 		consumer:  consumer,
+		opts:      opts,
 		result:    result,
 	}
 
@@ -87,6 +274,9 @@ func (self *Queue) Subscribe(consumer MessageConsumer) error {
 // Unsubscribe consumer from round-robin ring, it's safe to call this method
 // from multiple goroutines.
 //
+// Buffered deliveries not yet passed to consumer and unsettled deliveries
+// of consumer are requeued, delivery in progress is not interrupted.
+//
 // If consumer isn't already subscribed the returned error will be of type:
 // ErrConsumerNotFound
 func (self *Queue) Unsubscribe(consumer MessageConsumer) error {
@@ -113,10 +303,58 @@ func (self *Queue) Len() int {
 	return <-self.lenght
 }
 
+// Get removes single message from Queue and returns it, along with count
+// of messages remaining in Queue, it's safe to call this method from multiple
+// goroutines. Get competes with subscribed consumers for held messages.
+//
+// If Queue is empty Get returns immediately with nil message and zero count,
+// like AMQP basic.get-empty. Returned message is considered acknowledged,
+// like with AMQP basic.get no-ack flag.
+//
+// If context is done first the returned error is the one of ctx.Err(),
+// if Queue is closed the returned error will be of type: ErrQueueClosed
+func (self *Queue) Get(ctx context.Context) (Message, int, error) {
+	result := make(chan getResult, 1)
+
+	select {
+	case self.get <- result:
+		r := <-result
+		return r.msg, r.remaining, nil
+
+	case <-self.closing:
+		return nil, 0, ErrQueueClosed
+
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// Purge drops all messages held in Queue and returns their count, it's safe
+// to call this method from multiple goroutines.
+//
+// Purged messages are not dead-lettered, unsettled deliveries are not affected.
+// Purging closed Queue does nothing.
+func (self *Queue) Purge() int {
+	result := make(chan int, 1)
+
+	select {
+	case self.purge <- result:
+		return <-result
+
+	case <-self.closing:
+		return 0
+	}
+}
+
 // Close gracefully flushes messages to all subscribed consumers (if any),
 // and closes Queue.
 //
-// Is an error to use queue after it has been closed.
+// Is an error to use queue after it has been closed, except for publishing
+// and settling deliveries, which yield ErrQueueClosed. Messages requeued during
+// flush are dropped, as well as scheduled messages which are not due yet.
+//
+// Messages of DurableQueueHandler which were not delivered, or were not
+// settled before close, stay stored.
 func (self *Queue) Close() {
 	self.close(false)
 }
@@ -129,100 +367,301 @@ func (self *Queue) ForceClose() {
 }
 
 func (self *Queue) close(force bool) {
+	// Unblocks publishers waiting for inputHandler
+	close(self.closing)
+
 	self.quit <- force
 	self.quit <- force
 	<-self.quitCnf
 	<-self.quitCnf
+
+	self.mu.Lock()
+	// Messages requeued during flush are dropped
+	self.closed = true
+	self.returns = nil
+	settled := self.settled
+	self.settled = nil
+	self.mu.Unlock()
+
+	// inputHandler exited, so handler can be used here
+	for _, tag := range settled {
+		self.settleStored(tag)
+	}
+
+	close(self.done)
+	if self.dlx != nil {
+		<-self.quitCnf
+	}
 }
 
 func (self *Queue) inputHandler() {
+	var sweep <-chan time.Time
+	if _, ok := self.handler.(ExpiringQueueHandler); ok {
+		ticker := time.NewTicker(expirySweepInterval)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
 	for {
+		now := time.Now()
+		scheduled := self.advanceScheduled(now)
+		self.dropExpired(now)
+
 		if self.handler.Len() > 0 {
+			expired, stop := self.nextExpiration(now)
+
 			select {
 			case msg := <-self.input:
-				self.handler.Add(msg)
+				self.enqueue(msg, self.overflow, now)
+
+			case op := <-self.publish:
+				op.result <- self.enqueue(op.msg, op.overflow, now)
+
+			case self.output <- self.head():
+				self.take()
+
+			case result := <-self.get:
+				result <- getResult{
+					msg:       unwrapHeld(self.remove()),
+					remaining: self.handler.Len(),
+				}
 
-			case self.output <- self.handler.Peek():
-				self.handler.Remove()
+			case result := <-self.purge:
+				result <- self.purgeAll()
+
+			case op := <-self.browse:
+				op.result <- self.browseAll(op, time.Now())
 
 			case self.lenght <- self.handler.Len():
 				// Nothing here
 
-			case force := <-self.quit:
-				if !force {
-					for self.handler.Len() > 0 {
-						self.output <- self.handler.Peek()
-						self.handler.Remove()
-					}
-					close(self.output)
+			case <-self.returned:
+				self.addReturned()
+
+			case <-expired:
+				// Expired message is dropped in next iteration
+
+			case <-scheduled:
+				// Due messages are made visible in next iteration
+
+			case now := <-sweep:
+				expired := self.handler.(ExpiringQueueHandler).RemoveExpired(now)
+				for _, msg := range expired {
+					self.bytes -= len(msg.Body())
 				}
-				self.quitCnf <- true
+				self.deadLetter(DeadLetterExpired, expired...)
+
+			case force := <-self.quit:
+				stop()
+				self.flush(force)
 				return
 			}
+
+			stop()
 		} else {
 			select {
 			case msg := <-self.input:
-				self.handler.Add(msg)
+				self.enqueue(msg, self.overflow, now)
+
+			case op := <-self.publish:
+				op.result <- self.enqueue(op.msg, op.overflow, now)
 
 			case self.lenght <- 0:
 				// Nothing here
 
+			case result := <-self.get:
+				result <- getResult{}
+
+			case result := <-self.purge:
+				result <- 0
+
+			case op := <-self.browse:
+				op.result <- nil
+
+			case <-self.returned:
+				self.addReturned()
+
+			case <-scheduled:
+				// Due messages are made visible in next iteration
+
 			case force := <-self.quit:
-				if !force {
-					close(self.output)
-				}
-				self.quitCnf <- true
+				self.flush(force)
 				return
 			}
 		}
 	}
 }
 
+// flush passes all held messages to outputHandler, unless force is true.
+func (self *Queue) flush(force bool) {
+	self.addReturned()
+
+	if !force {
+		for self.dropExpired(time.Now()); self.handler.Len() > 0; self.dropExpired(time.Now()) {
+			self.output <- self.head()
+			self.take()
+		}
+		close(self.output)
+	}
+
+	self.quitCnf <- true
+}
+
+// addReturned moves requeued messages into handler, and settles stored
+// copies of messages which were requeued or settled.
+//
+// Stored copy of requeued message is kept when handler fails to add it.
+func (self *Queue) addReturned() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.singleActive && len(self.returns) > 0 {
+		self.addFront(self.returns)
+	} else {
+		for _, taken := range self.returns {
+			if self.add(taken.msg) == nil {
+				self.settleStored(taken.tag)
+			}
+		}
+	}
+	self.returns = nil
+
+	for _, tag := range self.settled {
+		self.settleStored(tag)
+	}
+	self.settled = nil
+}
+
+// purgeAll drops all messages from handler, it must be called only
+// by inputHandler.
+func (self *Queue) purgeAll() int {
+	count := self.handler.Len()
+	for self.handler.Len() > 0 {
+		self.remove()
+	}
+
+	return count
+}
+
+// add enqueues message in handler, it must be called only by inputHandler.
+func (self *Queue) add(msg Message) error {
+	visible := self.handler.Len()
+	if checked, ok := self.handler.(CheckedQueueHandler); ok {
+		if err := checked.AddChecked(msg); err != nil {
+			return err
+		}
+	} else {
+		self.handler.Add(msg)
+	}
+
+	// Scheduled messages are counted once they're due, see advanceScheduled()
+	if self.handler.Len() > visible {
+		self.bytes += len(msg.Body())
+	}
+
+	return nil
+}
+
+// remove dequeues message from handler and returns it, it must be called only
+// by inputHandler.
+func (self *Queue) remove() Message {
+	taken := self.take()
+	self.settleStored(taken.tag)
+
+	return taken.msg
+}
+
 func (self *Queue) outputHandler() {
-	rr := newRoundRobinHandler()
+	consumers := newConsumerPriorities(self.newDispatcher)
+	subs := make(map[MessageConsumer]*subscription)
+	state := dispatchState{queue: self, subs: subs}
+
+	// Output is closed by inputHandler on graceful close, before quit signal
+	// is received here
+	input := self.output
+
+	// held is a message received from inputHandler, for which Dispatcher
+	// did not choose consumer yet
+	var held *takenMessage
 
 	for {
-		if rr.Len() > 0 {
+		if consumers.Len() > 0 {
+			if held != nil && self.anyEligible(consumers, state) {
+				if consumer := self.nextEligible(consumers, state); consumer != nil {
+					self.deliver(subs[consumer], held)
+					held = nil
+				}
+			}
+
+			// Only this goroutine lowers consumers capacity, so eligible
+			// consumer is usually still available after message is received
+			var output chan *takenMessage
+			if held == nil && input != nil && self.anyEligible(consumers, state) {
+				output = input
+			}
+
 			select {
-			case msg := <-self.output:
-				rr.Next().Consume(msg)
+			case taken, ok := <-output:
+				if !ok {
+					input = nil
+					continue
+				}
 
-			case op := <-self.subscribeOp:
-				if op.subscribe {
-					op.result <- rr.Add(op.consumer)
+				if consumer := self.nextEligible(consumers, state); consumer != nil {
+					self.deliver(subs[consumer], taken)
 				} else {
-					op.result <- rr.Remove(op.consumer)
+					// Retried once consumers capacity changes
+					held = taken
 				}
 
+			case <-self.capacity:
+				// Consumers capacity may have changed
+
+			case op := <-self.subscribeOp:
+				op.result <- self.handleSubscriptionOp(consumers, subs, op)
+
 			case <-self.subscriptions:
-				list := make([]MessageConsumer, 0, rr.Len())
-				for subscriber := range rr.consumers {
+				list := make([]MessageConsumer, 0, consumers.Len())
+				for subscriber := range consumers.consumers {
 					list = append(list, subscriber)
 				}
 				self.subscriptions <- list
 
 			case force := <-self.quit:
+				// Prefetch limits and buffer sizes are ignored during flush
 				if !force {
-					for msg := range self.output {
-						rr.Next().Consume(msg)
+					flush := dispatchState{queue: self, subs: subs, flush: true}
+					if held != nil {
+						self.deliver(subs[self.flushTarget(consumers, flush)], held)
+					}
+
+					for taken := range self.output {
+						self.deliver(subs[self.flushTarget(consumers, flush)], taken)
 					}
 				}
+				self.stopDeliveries(subs, force)
 				self.quitCnf <- true
 				return
 			}
 		} else {
+			if held != nil {
+				// Last consumer unsubscribed before message was dispatched
+				self.mu.Lock()
+				self.returns = append(self.returns, held)
+				self.notifyReturned()
+				self.mu.Unlock()
+				held = nil
+			}
+
 			select {
 			case op := <-self.subscribeOp:
-				if op.subscribe {
-					op.result <- rr.Add(op.consumer)
-				} else {
-					op.result <- ErrConsumerNotFound
-				}
+				op.result <- self.handleSubscriptionOp(consumers, subs, op)
 
 			case <-self.subscriptions:
 				self.subscriptions <- nil
 
 			case force := <-self.quit:
+				// Messages are dropped, stored copies are kept
 				if !force {
 					for _ = range self.output {
 					}
@@ -234,14 +673,166 @@ func (self *Queue) outputHandler() {
 	}
 }
 
+func (self *Queue) handleSubscriptionOp(consumers *consumerPriorities, subs map[MessageConsumer]*subscription, op *subscriptionOp) error {
+	if op.subscribe {
+		sub := newSubscription(op.consumer, op.opts)
+		if err := consumers.Add(op.consumer, sub.priority); err != nil {
+			return err
+		}
+
+		subs[op.consumer] = sub
+		go self.deliveryLoop(sub)
+		return nil
+	}
+
+	if err := consumers.Remove(op.consumer); err != nil {
+		return err
+	}
+
+	self.cancel(subs[op.consumer])
+	delete(subs, op.consumer)
+	return nil
+}
+
+func (self *Queue) anyEligible(consumers *consumerPriorities, state dispatchState) bool {
+	if self.singleActive {
+		return state.Eligible(consumers.First())
+	}
+
+	for consumer := range state.subs {
+		if state.Eligible(consumer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextEligible returns consumer with the highest priority which has capacity,
+// chosen by Dispatcher, or nil if Dispatcher did not choose any.
+func (self *Queue) nextEligible(consumers *consumerPriorities, state dispatchState) MessageConsumer {
+	if self.singleActive {
+		return consumers.First()
+	}
+
+	return consumers.Next(state)
+}
+
+// flushTarget returns consumer receiving next message during flush, when
+// Dispatcher does not choose any, the first subscribed consumer is used.
+func (self *Queue) flushTarget(consumers *consumerPriorities, flush dispatchState) MessageConsumer {
+	if !self.singleActive {
+		if consumer := consumers.Next(flush); consumer != nil {
+			return consumer
+		}
+	}
+
+	return consumers.First()
+}
+
+// dispatchState implements DispatchState for outputHandler, during flush all
+// consumers are eligible.
+type dispatchState struct {
+	queue *Queue
+	subs  map[MessageConsumer]*subscription
+	flush bool
+}
+
+func (self dispatchState) Eligible(consumer MessageConsumer) bool {
+	return self.flush || self.queue.hasCapacity(self.subs[consumer])
+}
+
+func (self dispatchState) Outstanding(consumer MessageConsumer) int {
+	return self.queue.outstanding(self.subs[consumer])
+}
+
+func (self dispatchState) Weight(consumer MessageConsumer) int {
+	return self.subs[consumer].weight
+}
+
+// deliver buffers message for delivery goroutine of consumer.
+func (self *Queue) deliver(sub *subscription, taken *takenMessage) {
+	sub.push(self.newDelivery(sub, taken))
+}
+
+// deliveryLoop passes buffered deliveries to consumer, every subscription has
+// its own delivery goroutine, so slow consumer does not block others.
+// Deliveries which expired while buffered are dead-lettered instead.
+func (self *Queue) deliveryLoop(sub *subscription) {
+	defer close(sub.stopped)
+
+	for {
+		d, ok := sub.next()
+		if !ok {
+			return
+		}
+
+		// Message might have expired while buffered
+		if d.expired(time.Now()) {
+			self.expire(d)
+		} else {
+			sub.consumer.Consume(d)
+
+			if !sub.manualAck {
+				self.mu.Lock()
+				self.release(d)
+				self.mu.Unlock()
+			}
+		}
+		self.wakeup()
+	}
+}
+
+// stopDeliveries stops delivery goroutines of all consumers, on graceful
+// close buffered deliveries are passed to consumers before this method returns.
+func (self *Queue) stopDeliveries(subs map[MessageConsumer]*subscription, force bool) {
+	for _, sub := range subs {
+		sub.finish(force)
+	}
+
+	if !force {
+		for _, sub := range subs {
+			<-sub.stopped
+		}
+	}
+}
+
+func unwrapDelivery(msg Message) Message {
+	if d, ok := msg.(*Delivery); ok {
+		return d.Message
+	}
+
+	return msg
+}
+
+func unwrapHeld(msg Message) Message {
+	if h, ok := msg.(*heldMessage); ok {
+		return h.Message
+	}
+
+	return msg
+}
+
+type getResult struct {
+	msg       Message
+	remaining int
+}
+
+type publishOp struct {
+	msg      Message
+	overflow OverflowPolicy
+	result   chan error
+}
+
 type subscriptionOp struct {
 	subscribe bool
 	consumer  MessageConsumer
+	opts      []SubscribeOption
 	result    chan error
 }
 
 // Ensure *Queue implements Consumer interface
 var _ MessageConsumer = &Queue{}
 
-// Ensure *Queue implements RR Dispatch inetrface
-var _ RoundRobinDispatcher = &Queue{}
+// Ensure *Queue implements Dispatch inetrface
+var _ MessageDispatcher = &Queue{}
@@ -18,6 +18,9 @@ limitations under the License.
 package amq_test
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -228,6 +231,710 @@ func TestMessageQueue_QueueBalancesMessagesBetweenConsumers(t *testing.T) {
 	}
 }
 
+func TestMessageQueue_PrefetchLimitSkipsSaturatedConsumer(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	slow := make(deliveryConsumer, 10)
+	fast := make(deliveryConsumer, 10)
+
+	q.SubscribeWith(slow, amq.ManualAck(), amq.Prefetch(1, 0))
+	q.SubscribeWith(fast, amq.ManualAck())
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{})
+	}
+
+	for i := 0; i < 9; i++ {
+		fast.next(t)
+	}
+
+	d := slow.next(t)
+	slow.none(t)
+
+	if len(fast) != 0 {
+		t.Errorf("Unexpected deliveries count %d", len(fast))
+	}
+
+	q.Consume(testMsg{})
+	fast.next(t)
+
+	d.Ack(false)
+	q.Consume(testMsg{})
+	slow.next(t)
+}
+
+func TestMessageQueue_PrefetchHoldsMessagesUntilAck(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 10)
+	q.SubscribeWith(c, amq.ManualAck(), amq.Prefetch(2, 0))
+
+	for i := 0; i < 5; i++ {
+		q.Consume(testMsg{})
+	}
+
+	c.next(t)
+	d := c.next(t)
+	c.none(t)
+
+	if q.Len() != 3 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 3)
+	}
+
+	d.Ack(true)
+	c.next(t)
+	c.next(t)
+	c.none(t)
+}
+
+func TestMessageQueue_PrefetchSizeLimit(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	c := make(deliveryConsumer, 10)
+	q.SubscribeWith(c, amq.ManualAck(), amq.Prefetch(0, 10))
+
+	for i := 0; i < 3; i++ {
+		q.Consume(testMsg{body: make([]byte, 6)})
+	}
+
+	c.next(t)
+	d := c.next(t)
+	c.none(t)
+
+	d.Ack(true)
+	c.next(t)
+}
+
+func TestMessageQueue_MessageTTLExpiresMessages(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.MessageTTL(20*time.Millisecond))
+	defer q.Close()
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{})
+	}
+
+	if q.Len() != 10 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 10)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if q.Len() != 0 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 0)
+	}
+}
+
+func TestMessageQueue_MessageExpirationProperty(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.MessageTTL(time.Hour))
+	defer q.Close()
+
+	q.Consume(amq.NewMessageBuilder().Expiration("10").Build())
+	q.Consume(amq.NewMessageBuilder().RoutingKey("live").Build())
+
+	time.Sleep(20 * time.Millisecond)
+
+	c := make(deliveryConsumer, 2)
+	q.Subscribe(c)
+
+	if c.next(t).RoutingKey() != "live" {
+		t.Error("Unexpected message delivered")
+	}
+	c.none(t)
+}
+
+func TestMessageQueue_ExpiredMessagesAreNotDelivered(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.MessageTTL(10*time.Millisecond))
+
+	c := make(deliveryConsumer, 10)
+	q.SubscribeWith(c, amq.ManualAck(), amq.Prefetch(1, 0))
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{})
+	}
+
+	d := c.next(t)
+	time.Sleep(20 * time.Millisecond)
+	d.Ack(false)
+
+	c.none(t)
+	q.Close()
+
+	if len(c) != 0 {
+		t.Error("Expired messages were delivered")
+	}
+}
+
+func TestMessageQueue_PriorityQueueRemovesExpiredMessages(t *testing.T) {
+	q := amq.NewQueue(queue.NewPQHandler())
+	defer q.Close()
+
+	q.Consume(amq.NewMessageBuilder().Priority(9).Build())
+	q.Consume(amq.NewMessageBuilder().Priority(1).Expiration("1").Build())
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if q.Len() != 1 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 1)
+	}
+}
+
+func TestMessageQueue_PublishAfterCloseReturnsError(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	q.Close()
+
+	// Must not block
+	q.Consume(testMsg{})
+
+	if err := q.Publish(testMsg{}); err != amq.ErrQueueClosed {
+		t.Error("Unexpected error:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.ConsumeContext(ctx, testMsg{}); err != amq.ErrQueueClosed {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := q.TryConsume(testMsg{}); err != amq.ErrQueueClosed {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestMessageQueue_ConsumeContextEnqueuesMessage(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := q.ConsumeContext(ctx, testMsg{}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if q.Len() != 1 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 1)
+	}
+}
+
+func TestMessageQueue_TryConsumeDoesNotDropHead(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.MaxLength(1))
+	defer q.Close()
+
+	q.Publish(testMsg{routingKey: "first"})
+
+	if err := q.TryConsume(testMsg{routingKey: "second"}); err != amq.ErrQueueFull {
+		t.Error("Unexpected error:", err)
+	}
+
+	c := make(deliveryConsumer, 1)
+	q.Subscribe(c)
+
+	if msg := c.next(t); msg.RoutingKey() != "first" {
+		t.Error("Unexpected message delivered:", msg.RoutingKey())
+	}
+}
+
+func TestMessageQueue_ConcurrentTryConsumeOnUnboundedQueue(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := q.TryConsume(testMsg{}); err != nil {
+					t.Error("Unexpected error:", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if q.Len() != 800 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 800)
+	}
+}
+
+func TestMessageQueue_BufferedDeliveriesExpire(t *testing.T) {
+	dlx := make(messageConsumer, 10)
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.MessageTTL(50*time.Millisecond),
+		amq.DeadLetterExchange(dlx, ""),
+	)
+	defer q.Close()
+
+	c := newBlockingConsumer()
+	q.SubscribeWith(c, amq.ManualAck())
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{routingKey: strconv.Itoa(i)})
+	}
+
+	// Consumer is slow, remaining messages expire while buffered
+	<-c.calls
+	time.Sleep(100 * time.Millisecond)
+	close(c.release)
+
+	for i := 1; i < 10; i++ {
+		msg := dlx.next(t)
+		if reason := xDeath(t, msg, 0)["reason"]; reason != amq.DeadLetterExpired {
+			t.Error("Unexpected dead-letter reason:", reason)
+		}
+	}
+
+	select {
+	case <-c.calls:
+		t.Error("Expired message delivered")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestMessageQueue_BlockedConsumerDoesNotStallOthers(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.ForceClose()
+
+	blocked := newBlockingConsumer()
+	defer close(blocked.release)
+
+	fast := make(deliveryConsumer, 10)
+
+	q.SubscribeWith(blocked, amq.DeliveryBuffer(1))
+	q.Subscribe(fast)
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{})
+	}
+
+	// Blocked consumer holds one message in Consume() and one in buffer
+	for i := 0; i < 8; i++ {
+		fast.next(t)
+	}
+
+	if len(q.Subscriptions()) != 2 {
+		t.Error("Unexpected subscriptions list")
+	}
+
+	if err := q.Unsubscribe(fast); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestMessageQueue_UnsubscribeRequeuesBufferedMessages(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	blocked := newBlockingConsumer()
+	q.SubscribeWith(blocked, amq.DeliveryBuffer(5))
+
+	for i := 0; i < 3; i++ {
+		q.Consume(testMsg{})
+	}
+
+	// Wait for first message to reach Consume() call
+	<-blocked.calls
+
+	if err := q.Unsubscribe(blocked); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	close(blocked.release)
+
+	c := make(deliveryConsumer, 2)
+	q.Subscribe(c)
+
+	for i := 0; i < 2; i++ {
+		if c.next(t).Redelivered() {
+			t.Error("Unexpected redelivered flag")
+		}
+	}
+	c.none(t)
+}
+
+func TestMessageQueue_ConsumerPriorityFallsBackWhenSaturated(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	high := make(deliveryConsumer, 10)
+	low := make(deliveryConsumer, 10)
+
+	q.SubscribeWith(low, amq.ConsumerPriority(1))
+	q.SubscribeWith(high, amq.ManualAck(), amq.Prefetch(2, 0), amq.ConsumerPriority(10))
+
+	for i := 0; i < 5; i++ {
+		q.Consume(testMsg{})
+	}
+
+	high.next(t)
+	d := high.next(t)
+	high.none(t)
+
+	for i := 0; i < 3; i++ {
+		low.next(t)
+	}
+
+	d.Ack(true)
+	q.Consume(testMsg{})
+
+	high.next(t)
+	low.none(t)
+}
+
+func TestMessageQueue_SingleActiveConsumerTakeover(t *testing.T) {
+	// Requeued messages are added at the front, or rotated in front of held
+	// messages when handler can't add at the front
+	for _, handler := range []amq.QueueHandler{
+		queue.NewQueueHandler(),
+		fifoHandler{queue.NewQueueHandler()},
+	} {
+		q := amq.NewQueue(handler, amq.SingleActiveConsumer())
+
+		active := make(deliveryConsumer, 10)
+		standby := make(deliveryConsumer, 10)
+
+		q.SubscribeWith(active, amq.ManualAck(), amq.Prefetch(2, 0))
+		q.SubscribeWith(standby, amq.ManualAck(), amq.ConsumerPriority(10))
+
+		for i := 0; i < 5; i++ {
+			q.Consume(testMsg{routingKey: strconv.Itoa(i)})
+		}
+
+		for i := 0; i < 2; i++ {
+			if msg := active.next(t); msg.RoutingKey() != strconv.Itoa(i) {
+				t.Error("Unexpected message delivered:", msg.RoutingKey())
+			}
+		}
+		active.none(t)
+		standby.none(t)
+
+		q.Unsubscribe(active)
+
+		for i := 0; i < 5; i++ {
+			d := standby.next(t)
+			if d.RoutingKey() != strconv.Itoa(i) {
+				t.Error("Unexpected message delivered:", d.RoutingKey())
+			}
+			if d.Redelivered() != (i < 2) {
+				t.Error("Unexpected redelivered flag:", d.Redelivered())
+			}
+		}
+
+		q.Close()
+	}
+}
+
+func TestMessageQueue_SingleActiveConsumerKeepsMessagesHandlerFailsToAdd(t *testing.T) {
+	handler := &failingHandler{QueueHandler: queue.NewQueueHandler()}
+	q := amq.NewQueue(handler, amq.SingleActiveConsumer())
+	defer q.Close()
+
+	active := make(deliveryConsumer, 10)
+	standby := make(deliveryConsumer, 10)
+
+	q.SubscribeWith(active, amq.ManualAck(), amq.Prefetch(1, 0))
+	q.SubscribeWith(standby, amq.ManualAck())
+
+	for i := 0; i < 3; i++ {
+		q.Consume(testMsg{routingKey: strconv.Itoa(i)})
+	}
+	active.next(t)
+
+	handler.setFailing(true)
+	q.Unsubscribe(active)
+
+	for i := 1; i < 3; i++ {
+		if d := standby.next(t); d.RoutingKey() != strconv.Itoa(i) {
+			t.Error("Unexpected message delivered:", d.RoutingKey())
+		}
+	}
+}
+
+func TestMessageQueue_DispatcherMayChooseNoConsumer(t *testing.T) {
+	dispatcher := &pausedDispatcher{Dispatcher: amq.NewRoundRobinDispatcher()}
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.DispatchStrategy(func() amq.Dispatcher { return dispatcher }),
+	)
+	defer q.Close()
+
+	first := make(messageConsumer, 1)
+	q.Subscribe(first)
+	q.Consume(testMsg{routingKey: "held"})
+	first.none(t)
+
+	// Subscription makes Queue dispatch held message again
+	dispatcher.resume()
+	second := make(messageConsumer, 1)
+	q.Subscribe(second)
+
+	select {
+	case msg := <-first:
+		if msg.RoutingKey() != "held" {
+			t.Error("Unexpected message received:", msg.RoutingKey())
+		}
+	case msg := <-second:
+		if msg.RoutingKey() != "held" {
+			t.Error("Unexpected message received:", msg.RoutingKey())
+		}
+	case <-time.After(time.Second):
+		t.Error("Held message not delivered")
+	}
+}
+
+func TestMessageQueue_LeastOutstandingDispatchStrategy(t *testing.T) {
+	q := amq.NewQueue(
+		queue.NewQueueHandler(),
+		amq.DispatchStrategy(amq.NewLeastOutstandingDispatcher),
+	)
+	defer q.Close()
+
+	busy := make(deliveryConsumer, 10)
+	idle := make(deliveryConsumer, 10)
+
+	q.SubscribeWith(busy, amq.ManualAck())
+	q.Consume(testMsg{})
+	q.Consume(testMsg{})
+	busy.next(t)
+	busy.next(t)
+
+	q.SubscribeWith(idle, amq.ManualAck())
+	for i := 0; i < 2; i++ {
+		q.Consume(testMsg{})
+	}
+
+	idle.next(t)
+	idle.next(t)
+	busy.none(t)
+}
+
+func TestMessageQueue_GetReturnsMessagesWithRemainingCount(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler(), amq.MessageTTL(time.Hour))
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		q.Consume(testMsg{routingKey: strconv.Itoa(i)})
+	}
+
+	for i := 0; i < 3; i++ {
+		msg, remaining, err := q.Get(context.Background())
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		if _, ok := msg.(testMsg); !ok || msg.RoutingKey() != strconv.Itoa(i) {
+			t.Error("Unexpected message returned:", msg)
+		}
+
+		if remaining != 2-i {
+			t.Errorf("Unexpected remaining count %d, expected %d", remaining, 2-i)
+		}
+	}
+
+}
+
+func TestMessageQueue_GetOnEmptyQueueReturnsImmediately(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg, remaining, err := q.Get(ctx)
+	if msg != nil || remaining != 0 || err != nil {
+		t.Error("Unexpected result:", msg, remaining, err)
+	}
+
+	q.Close()
+
+	if _, _, err := q.Get(context.Background()); err != amq.ErrQueueClosed {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestMessageQueue_PurgeDropsAllMessages(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	if count := q.Purge(); count != 0 {
+		t.Errorf("Unexpected purged count %d, expected %d", count, 0)
+	}
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{})
+	}
+
+	if count := q.Purge(); count != 10 {
+		t.Errorf("Unexpected purged count %d, expected %d", count, 10)
+	}
+
+	if q.Len() != 0 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 0)
+	}
+}
+
+func TestMessageQueue_BrowseDoesNotRemoveMessages(t *testing.T) {
+	q := amq.NewQueue(queue.NewQueueHandler())
+	defer q.Close()
+
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{routingKey: strconv.Itoa(i)})
+	}
+
+	msgs, err := q.Browse(nil, 0)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if len(msgs) != 10 {
+		t.Fatalf("Unexpected browsed count %d, expected %d", len(msgs), 10)
+	}
+
+	for i, msg := range msgs {
+		if msg.RoutingKey() != strconv.Itoa(i) {
+			t.Errorf("Unexpected message order, expected %d got %s", i, msg.RoutingKey())
+		}
+	}
+
+	if msgs, _ := q.Browse(nil, 3); len(msgs) != 3 {
+		t.Errorf("Unexpected browsed count %d, expected %d", len(msgs), 3)
+	}
+
+	if q.Len() != 10 {
+		t.Errorf("Queue has unexpected size %d != %d", q.Len(), 10)
+	}
+}
+
+func TestMessageQueue_BrowseFilters(t *testing.T) {
+	q := amq.NewQueue(queue.NewPQHandler(), amq.MessageTTL(time.Hour))
+	defer q.Close()
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		q.Consume(testMsg{
+			headers:   amq.Headers{"odd": i%2 == 1},
+			priority:  uint8(i),
+			timestamp: now.Add(-time.Duration(i) * time.Minute),
+		})
+	}
+
+	cases := []struct {
+		filter     amq.BrowseFilter
+		priorities []uint8
+	}{
+		{amq.PriorityFilter(3, 5), []uint8{5, 4, 3}},
+		{amq.AgeFilter(7*time.Minute, 0), []uint8{9, 8, 7}},
+		{amq.AgeFilter(0, 90*time.Second), []uint8{1, 0}},
+		{amq.AllOf(
+			amq.PriorityFilter(2, 9),
+			amq.HeadersFilter(func(h amq.Headers) bool { return h["odd"] == true }),
+		), []uint8{9, 7, 5, 3}},
+		{amq.RoutingKeyFilter(func(key string) bool { return key != "" }), nil},
+	}
+
+	for i, testCase := range cases {
+		msgs, err := q.Browse(testCase.filter, 0)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		if len(msgs) != len(testCase.priorities) {
+			t.Errorf("case: %d; Unexpected browsed count %d, expected %d", i+1, len(msgs), len(testCase.priorities))
+			continue
+		}
+
+		for j, msg := range msgs {
+			if _, ok := msg.(testMsg); !ok || msg.Priority() != testCase.priorities[j] {
+				t.Errorf("case: %d; Unexpected message browsed: %v", i+1, msg)
+			}
+		}
+	}
+}
+
+func TestMessageQueue_BrowseRequiresIterableHandler(t *testing.T) {
+	q := amq.NewQueue(fifoHandler{queue.NewQueueHandler()})
+	defer q.Close()
+
+	if _, err := q.Browse(nil, 0); err != amq.ErrBrowseNotSupported {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestMessageQueue_RecoversDurableMessages(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := queue.NewWALHandler(dir)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	q := amq.NewQueue(wal)
+	for i := 0; i < 5; i++ {
+		q.Publish(amq.NewMessageBuilder().
+			RoutingKey(strconv.Itoa(i)).
+			DeliveryMode(amq.Persistent).
+			Build())
+	}
+
+	// Graceful close would drain held messages
+	q.ForceClose()
+	wal.Close()
+
+	if wal, err = queue.NewWALHandler(dir); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer wal.Close()
+
+	q = amq.NewQueue(wal)
+	defer q.Close()
+
+	if q.Len() != 5 {
+		t.Fatalf("Queue has unexpected size %d != %d", q.Len(), 5)
+	}
+
+	c := make(messageConsumer, 5)
+	q.Subscribe(c)
+
+	for i := 0; i < 5; i++ {
+		if msg := c.next(t); msg.RoutingKey() != strconv.Itoa(i) {
+			t.Error("Unexpected message received:", msg.RoutingKey())
+		}
+	}
+}
+
+// fifoHandler hides optional interfaces implemented by wrapped handler
+type fifoHandler struct {
+	amq.QueueHandler
+}
+
+// failingHandler hides optional interfaces implemented by wrapped handler,
+// and fails to add messages while failing
+type failingHandler struct {
+	amq.QueueHandler
+	mu      sync.Mutex
+	failing bool
+}
+
+func (self *failingHandler) setFailing(failing bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.failing = failing
+}
+
+func (self *failingHandler) AddChecked(msg amq.Message) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.failing {
+		return errors.New("Test: Add failed")
+	}
+
+	self.Add(msg)
+	return nil
+}
+
 type testMsg struct {
 	headers    amq.Headers
 	routingKey string
@@ -267,3 +974,47 @@ func (self *countingConsumer) Consume(msg amq.Message) {
 
 	self.callsCount++
 }
+
+// pausedDispatcher chooses no consumer until it's resumed.
+type pausedDispatcher struct {
+	amq.Dispatcher
+
+	mu      sync.Mutex
+	resumed bool
+}
+
+func (self *pausedDispatcher) Next(state amq.DispatchState) amq.MessageConsumer {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if !self.resumed {
+		return nil
+	}
+
+	return self.Dispatcher.Next(state)
+}
+
+func (self *pausedDispatcher) resume() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.resumed = true
+}
+
+// blockingConsumer blocks in Consume() until release channel is closed,
+// each call is reported on calls channel first.
+type blockingConsumer struct {
+	calls, release chan struct{}
+}
+
+func newBlockingConsumer() *blockingConsumer {
+	return &blockingConsumer{
+		calls:   make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (self *blockingConsumer) Consume(msg amq.Message) {
+	self.calls <- struct{}{}
+	<-self.release
+}
@@ -27,12 +27,12 @@ var (
 
 type consumerRoundRobin struct {
 	ring      *consumersRing
-	consumers map[MessageConsumer]struct{}
+	consumers map[MessageConsumer]*consumersRing
 }
 
 func newRoundRobinHandler() *consumerRoundRobin {
 	return &consumerRoundRobin{
-		consumers: make(map[MessageConsumer]struct{}),
+		consumers: make(map[MessageConsumer]*consumersRing),
 	}
 }
 
@@ -45,17 +45,22 @@ func (self *consumerRoundRobin) Add(consumer MessageConsumer) error {
 		return ErrConsumerAlreadySubscribed
 	}
 
-	self.ring = self.ring.add(consumer)
-	self.consumers[consumer] = struct{}{}
+	elem := &consumersRing{
+		consumer: consumer,
+	}
+
+	self.ring = self.ring.add(elem)
+	self.consumers[consumer] = elem
 	return nil
 }
 
 func (self *consumerRoundRobin) Remove(consumer MessageConsumer) error {
-	if _, found := self.consumers[consumer]; !found {
+	elem, found := self.consumers[consumer]
+	if !found {
 		return ErrConsumerNotFound
 	}
 
-	self.ring = self.ring.remove(consumer)
+	self.ring = self.ring.remove(elem)
 	delete(self.consumers, consumer)
 	return nil
 }
@@ -70,11 +75,8 @@ type consumersRing struct {
 	consumer   MessageConsumer
 }
 
-func (self *consumersRing) add(consumer MessageConsumer) *consumersRing {
-	elem := &consumersRing{
-		consumer: consumer,
-	}
-
+// add inserts elem at the end of the ring, and returns head of the ring.
+func (self *consumersRing) add(elem *consumersRing) *consumersRing {
 	if self == nil {
 		elem.prev = elem
 		elem.next = elem
@@ -90,20 +92,18 @@ func (self *consumersRing) add(consumer MessageConsumer) *consumersRing {
 	return self
 }
 
-func (self *consumersRing) remove(consumer MessageConsumer) *consumersRing {
-	// find element whose next ring element contains consumer to remove
-	current := self
-	for current.next.consumer != consumer {
-		current = current.next
+// remove unlinks elem from the ring, and returns head of the ring.
+func (self *consumersRing) remove(elem *consumersRing) *consumersRing {
+	// Removing the only element leaves empty ring
+	if self.next == self {
+		return nil
 	}
 
-	// Move next pointer
-	current.next = current.next.next
-	// Fix previous pointer of next element
-	current.next.prev = current
+	elem.prev.next = elem.next
+	elem.next.prev = elem.prev
 
-	if self.consumer == consumer {
-		return self.next
+	if self == elem {
+		return elem.next
 	}
 
 	return self
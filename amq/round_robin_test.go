@@ -217,3 +217,19 @@ type testConsumer chan Message
 func (self testConsumer) Consume(msg Message) {
 	self <- msg
 }
+
+func TestRoundRobinHandler_RemovingLastConsumerEmptiesRing(t *testing.T) {
+	rr := newRoundRobinHandler()
+	c1 := make(testConsumer)
+	c2 := make(testConsumer)
+
+	rr.Add(c1)
+	rr.Remove(c1)
+	rr.Add(c2)
+
+	for i := 0; i < 3; i++ {
+		if result := rr.Next(); result != c2 {
+			t.Error("Round-Robin returned unexpected consumer")
+		}
+	}
+}
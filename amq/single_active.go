@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amq
+
+// FrontQueueHandler is an interface implemented by FIFO QueueHandlers capable
+// of enqueueing message at the front of queue, Queue uses it to requeue
+// messages in SingleActiveConsumer mode. Stored copy of requeued message is
+// settled once it's passed to AddFront().
+type FrontQueueHandler interface {
+	QueueHandler
+	AddFront(Message)
+}
+
+// SingleActiveConsumer makes Queue deliver messages only to the earliest
+// subscribed consumer, like x-single-active-consumer queue argument, other
+// consumers are standbys. When active consumer unsubscribes, the next one
+// in subscription order takes over, consumer priorities are ignored.
+//
+// Messages requeued in this mode are put back in front of held messages,
+// in their delivery order, so consumers observe strict ordering. Unless
+// handler implements FrontQueueHandler, this costs a pass over all held
+// messages per requeue.
+func SingleActiveConsumer() QueueOption {
+	return func(q *Queue) {
+		q.singleActive = true
+	}
+}
+
+// addFront puts requeued messages back in front of held ones, in their
+// delivery order, it must be called only by inputHandler.
+func (self *Queue) addFront(returns []*takenMessage) {
+	if front, ok := self.handler.(FrontQueueHandler); ok {
+		for i := len(returns) - 1; i >= 0; i-- {
+			front.AddFront(returns[i].msg)
+			self.bytes += len(returns[i].msg.Body())
+			self.settleStored(returns[i].tag)
+		}
+		return
+	}
+
+	held := self.handler.Len()
+	for _, taken := range returns {
+		if self.add(taken.msg) == nil {
+			self.settleStored(taken.tag)
+		}
+	}
+	self.moveToFront(held)
+}
+
+// moveToFront moves messages added after first held ones in front of them,
+// it must be called only by inputHandler.
+//
+// Message which handler fails to add again is kept in place, unchecked, its
+// stored copy is kept too.
+func (self *Queue) moveToFront(held int) {
+	for i := 0; i < held; i++ {
+		taken := self.take()
+		if self.add(taken.msg) == nil {
+			self.settleStored(taken.tag)
+			continue
+		}
+
+		visible := self.handler.Len()
+		self.handler.Add(taken.msg)
+		if self.handler.Len() > visible {
+			self.bytes += len(taken.msg.Body())
+		}
+	}
+}
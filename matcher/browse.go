@@ -0,0 +1,37 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matcher
+
+import (
+	"github.com/canni/paperboymq/amq"
+)
+
+// TopicFilter returns BrowseFilter matching messages with routing key matching
+// given topic pattern, see TopicMatches().
+func TopicFilter(pattern string) amq.BrowseFilter {
+	return amq.RoutingKeyFilter(func(routingKey string) bool {
+		return TopicMatches(pattern, routingKey)
+	})
+}
+
+// HeadersFilter returns BrowseFilter matching messages with headers matching
+// given binding arguments, see HeadersMatch().
+func HeadersFilter(arguments amq.Headers) amq.BrowseFilter {
+	return amq.HeadersFilter(func(headers amq.Headers) bool {
+		return HeadersMatch(headers, arguments)
+	})
+}
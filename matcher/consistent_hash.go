@@ -0,0 +1,204 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+var (
+	ErrInvalidWeight = errors.New("Consistent hash: Binding key is not a valid weight")
+)
+
+// ringPointsPerWeight is a number of hash ring points per unit of binding weight.
+const ringPointsPerWeight = 64
+
+// HashKey returns message attribute hashed by consistent-hash matcher.
+type HashKey func(amq.Message) string
+
+// HashRoutingKey hashes message routing key.
+func HashRoutingKey(msg amq.Message) string {
+	return msg.RoutingKey()
+}
+
+// HashMessageId hashes message-id property of message.
+func HashMessageId(msg amq.Message) string {
+	return amq.PropertiesOf(msg).MessageId
+}
+
+// HashHeader returns HashKey hashing value of named message header,
+// missing header is hashed as empty string.
+func HashHeader(name string) HashKey {
+	return func(msg amq.Message) string {
+		if value, found := msg.Headers()[name]; found {
+			return fmt.Sprint(value)
+		}
+
+		return ""
+	}
+}
+
+// ConsistentHash matcher routes every message to single binding, chosen
+// by hashing message routing key onto a hash ring.
+var ConsistentHash = NewConsistentHash("consistent-hash", HashRoutingKey)
+
+// NewConsistentHash returns SelectingMatcher routing every message to single
+// binding, chosen by hashing message attribute returned by key onto a hash ring.
+//
+// Binding key is a positive integer weight of binding, binding with weight 2
+// receives roughly twice as many messages as binding with weight 1. Exchange
+// returns ErrInvalidWeight when binding with invalid key is bound.
+//
+// Ring position of binding is derived from Name() of bound consumer (like
+// named Queue) if it has one, so routing is stable across restarts.
+func NewConsistentHash(name string, key HashKey) amq.Matcher {
+	return &consistentHashMatcher{
+		name: name,
+		key:  key,
+	}
+}
+
+type consistentHashMatcher struct {
+	name string
+	key  HashKey
+}
+
+// Matches always returns false, consistent-hash matcher is not able to decide
+// per binding, Exchange uses BindingSelector instead.
+func (self *consistentHashMatcher) Matches(msg amq.Message, binding *amq.Binding) bool {
+	return false
+}
+
+func (self *consistentHashMatcher) NewSelector() amq.BindingSelector {
+	return &hashRing{
+		key: self.key,
+	}
+}
+
+func (self *consistentHashMatcher) String() string {
+	return self.name
+}
+
+type ringPoint struct {
+	hash    uint32
+	binding *amq.Binding
+}
+
+type hashRing struct {
+	key    HashKey
+	points []ringPoint
+}
+
+func (self *hashRing) Add(binding *amq.Binding) error {
+	weight, err := strconv.ParseUint(binding.Key, 10, 16)
+	if err != nil || weight == 0 {
+		return ErrInvalidWeight
+	}
+
+	id := bindingId(binding)
+	for i := 0; i < int(weight)*ringPointsPerWeight; i++ {
+		self.points = append(self.points, ringPoint{
+			hash:    hash(id + "#" + strconv.Itoa(i)),
+			binding: binding,
+		})
+	}
+
+	sort.Sort(byHash(self.points))
+	return nil
+}
+
+func (self *hashRing) Remove(binding *amq.Binding) {
+	points := self.points[:0]
+	for _, point := range self.points {
+		if point.binding != binding {
+			points = append(points, point)
+		}
+	}
+
+	// Clear references to removed bindings
+	for i := len(points); i < len(self.points); i++ {
+		self.points[i] = ringPoint{}
+	}
+
+	self.points = points
+}
+
+func (self *hashRing) Select(msg amq.Message) *amq.Binding {
+	if len(self.points) == 0 {
+		return nil
+	}
+
+	h := hash(self.key(msg))
+	i := sort.Search(len(self.points), func(i int) bool {
+		return self.points[i].hash >= h
+	})
+
+	if i == len(self.points) {
+		i = 0
+	}
+
+	return self.points[i].binding
+}
+
+func bindingId(binding *amq.Binding) string {
+	if named, ok := binding.Consumer.(interface {
+		Name() string
+	}); ok && named.Name() != "" {
+		return named.Name()
+	}
+
+	return fmt.Sprintf("%p", binding)
+}
+
+// hash returns FNV-1a hash of s, with bits mixed by MurmurHash3 finalizer,
+// so similar strings are spread evenly over the ring.
+func hash(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return uint32(x >> 32)
+}
+
+type byHash []ringPoint
+
+func (self byHash) Len() int {
+	return len(self)
+}
+
+func (self byHash) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self byHash) Less(i, j int) bool {
+	return self[i].hash < self[j].hash
+}
+
+// Ensure consistent-hash matcher implements SelectingMatcher interface
+var _ amq.SelectingMatcher = &consistentHashMatcher{}
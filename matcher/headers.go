@@ -0,0 +1,213 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matcher
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+// Values of x-match binding argument.
+const (
+	MatchAll      = "all"
+	MatchAny      = "any"
+	MatchAllWithX = "all-with-x"
+	MatchAnyWithX = "any-with-x"
+)
+
+func headersMatchFunc(msg amq.Message, binding *amq.Binding) bool {
+	return HeadersMatch(msg.Headers(), binding.Arguments)
+}
+
+// HeadersMatch reports whatever headers match binding arguments.
+//
+// The x-match argument selects whatever all (the default) or any of remaining
+// arguments has to be present in headers with equal value, nil argument value
+// requires only presence of header. Arguments prefixed with "x-" are ignored,
+// unless x-match is one of all-with-x or any-with-x.
+//
+// Values are compared according to AMQP field types, so integers and floats
+// of different Go types are equal when their values are, same goes for strings
+// and byte slices, nested tables and arrays are compared recursively.
+func HeadersMatch(headers, arguments amq.Headers) bool {
+	mode, _ := arguments["x-match"].(string)
+	withX := mode == MatchAllWithX || mode == MatchAnyWithX
+	any := mode == MatchAny || mode == MatchAnyWithX
+
+	for name, expected := range arguments {
+		if name == "x-match" || (!withX && strings.HasPrefix(name, "x-")) {
+			continue
+		}
+
+		value, found := headers[name]
+		matches := found && (expected == nil || valuesEqual(expected, value))
+
+		if any && matches {
+			return true
+		}
+
+		if !any && !matches {
+			return false
+		}
+	}
+
+	return !any
+}
+
+func valuesEqual(l, r interface{}) bool {
+	if ln, ok := toNumber(l); ok {
+		rn, ok := toNumber(r)
+		return ok && ln.equal(rn)
+	}
+
+	switch lv := l.(type) {
+	case string:
+		switch rv := r.(type) {
+		case string:
+			return lv == rv
+		case []byte:
+			return lv == string(rv)
+		}
+		return false
+
+	case []byte:
+		switch rv := r.(type) {
+		case string:
+			return string(lv) == rv
+		case []byte:
+			return bytes.Equal(lv, rv)
+		}
+		return false
+
+	case time.Time:
+		rv, ok := r.(time.Time)
+		return ok && lv.Equal(rv)
+
+	case amq.Headers:
+		return tablesEqual(lv, r)
+
+	case map[string]interface{}:
+		return tablesEqual(amq.Headers(lv), r)
+
+	case []interface{}:
+		rv, ok := r.([]interface{})
+		if !ok || len(lv) != len(rv) {
+			return false
+		}
+		for i := range lv {
+			if !valuesEqual(lv[i], rv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(l, r)
+}
+
+func tablesEqual(l amq.Headers, r interface{}) bool {
+	var rv amq.Headers
+	switch v := r.(type) {
+	case amq.Headers:
+		rv = v
+	case map[string]interface{}:
+		rv = amq.Headers(v)
+	default:
+		return false
+	}
+
+	if len(l) != len(rv) {
+		return false
+	}
+
+	for k, v := range l {
+		if other, found := rv[k]; !found || !valuesEqual(v, other) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// number holds any of AMQP numeric field values.
+type number struct {
+	kind reflect.Kind // One of Int64, Uint64 or Float64
+	i    int64
+	u    uint64
+	f    float64
+}
+
+func toNumber(v interface{}) (number, bool) {
+	switch n := v.(type) {
+	case int:
+		return number{kind: reflect.Int64, i: int64(n)}, true
+	case int8:
+		return number{kind: reflect.Int64, i: int64(n)}, true
+	case int16:
+		return number{kind: reflect.Int64, i: int64(n)}, true
+	case int32:
+		return number{kind: reflect.Int64, i: int64(n)}, true
+	case int64:
+		return number{kind: reflect.Int64, i: n}, true
+	case uint:
+		return number{kind: reflect.Uint64, u: uint64(n)}, true
+	case uint8:
+		return number{kind: reflect.Uint64, u: uint64(n)}, true
+	case uint16:
+		return number{kind: reflect.Uint64, u: uint64(n)}, true
+	case uint32:
+		return number{kind: reflect.Uint64, u: uint64(n)}, true
+	case uint64:
+		return number{kind: reflect.Uint64, u: n}, true
+	case float32:
+		return number{kind: reflect.Float64, f: float64(n)}, true
+	case float64:
+		return number{kind: reflect.Float64, f: n}, true
+	}
+
+	return number{}, false
+}
+
+func (self number) float() float64 {
+	switch self.kind {
+	case reflect.Int64:
+		return float64(self.i)
+	case reflect.Uint64:
+		return float64(self.u)
+	}
+
+	return self.f
+}
+
+func (self number) equal(other number) bool {
+	switch {
+	case self.kind == reflect.Float64 || other.kind == reflect.Float64:
+		return self.float() == other.float()
+
+	case self.kind == other.kind:
+		return self.i == other.i && self.u == other.u
+
+	case self.kind == reflect.Int64:
+		return self.i >= 0 && uint64(self.i) == other.u
+	}
+
+	return other.i >= 0 && uint64(other.i) == self.u
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matcher
+
+import (
+	"github.com/canni/paperboymq/amq"
+)
+
+type directMatcher struct {
+	*matcherImpl
+}
+
+func (self *directMatcher) NewIndex() amq.BindingIndex {
+	return directIndex{}
+}
+
+// directIndex maps binding keys to bindings.
+type directIndex map[string][]*amq.Binding
+
+func (self directIndex) Add(binding *amq.Binding) error {
+	self[binding.Key] = append(self[binding.Key], binding)
+	return nil
+}
+
+func (self directIndex) Remove(binding *amq.Binding) {
+	bindings := removeBinding(self[binding.Key], binding)
+	if len(bindings) == 0 {
+		delete(self, binding.Key)
+	} else {
+		self[binding.Key] = bindings
+	}
+}
+
+func (self directIndex) Match(msg amq.Message) []*amq.Binding {
+	return self[msg.RoutingKey()]
+}
+
+type fanoutMatcher struct {
+	*matcherImpl
+}
+
+func (self *fanoutMatcher) NewIndex() amq.BindingIndex {
+	return &fanoutIndex{}
+}
+
+// fanoutIndex holds list of all bindings.
+type fanoutIndex struct {
+	bindings []*amq.Binding
+}
+
+func (self *fanoutIndex) Add(binding *amq.Binding) error {
+	self.bindings = append(self.bindings, binding)
+	return nil
+}
+
+func (self *fanoutIndex) Remove(binding *amq.Binding) {
+	self.bindings = removeBinding(self.bindings, binding)
+}
+
+func (self *fanoutIndex) Match(msg amq.Message) []*amq.Binding {
+	return self.bindings
+}
+
+// removeBinding removes binding from slice in place.
+func removeBinding(bindings []*amq.Binding, binding *amq.Binding) []*amq.Binding {
+	for i, b := range bindings {
+		if b == binding {
+			copy(bindings[i:], bindings[i+1:])
+			bindings[len(bindings)-1] = nil
+			return bindings[:len(bindings)-1]
+		}
+	}
+
+	return bindings
+}
+
+// Ensure Direct matcher implements IndexingMatcher interface
+var _ amq.IndexingMatcher = &directMatcher{}
+
+// Ensure Fanout matcher implements IndexingMatcher interface
+var _ amq.IndexingMatcher = &fanoutMatcher{}
@@ -18,24 +18,32 @@ limitations under the License.
 package matcher
 
 import (
-	"fmt"
-	"regexp"
-	"strings"
-	"sync"
-
 	"github.com/canni/paperboymq/amq"
 )
 
 // Direct matcher matches if both, message routing key and binding key are equal.
-var Direct = New("direct", directMatchFunc)
+//
+// Direct matcher implements amq.IndexingMatcher, Exchange routes messages
+// through hash index of binding keys.
+var Direct amq.Matcher = &directMatcher{New("direct", directMatchFunc).(*matcherImpl)}
 
 // Fanout matcher always matches
-var Fanout = New("fanout", fanoutMatchFunc)
+//
+// Fanout matcher implements amq.IndexingMatcher, Exchange routes messages
+// to precomputed list of all bindings.
+var Fanout amq.Matcher = &fanoutMatcher{New("fanout", fanoutMatchFunc).(*matcherImpl)}
 
 // Topic matcher matches when routing key matches binding pattern, see AMQP
 // specification for detailed information. There is no need to rewrite all
 // rules here.
-var Topic = New("topic", topicMatchFunc)
+//
+// Topic matcher implements amq.IndexingMatcher, Exchange routes messages
+// through word-trie index, see TopicMatches() for matching rules.
+var Topic amq.Matcher = &topicMatcher{New("topic", topicMatchFunc).(*matcherImpl)}
+
+// Headers matcher matches when message headers match binding arguments,
+// according to x-match binding argument, see HeadersMatch() for details.
+var Headers = New("headers", headersMatchFunc)
 
 func directMatchFunc(msg amq.Message, binding *amq.Binding) bool {
 	return msg.RoutingKey() == binding.Key
@@ -45,38 +53,8 @@ func fanoutMatchFunc(msg amq.Message, binding *amq.Binding) bool {
 	return true
 }
 
-var patternCache = struct {
-	cache map[string]*regexp.Regexp
-	sync.RWMutex
-}{
-	cache: make(map[string]*regexp.Regexp),
-}
-
 func topicMatchFunc(msg amq.Message, binding *amq.Binding) bool {
-	patternCache.RLock()
-	defer patternCache.RUnlock()
-
-	if matcher, found := patternCache.cache[binding.Key]; found {
-		return matcher.MatchString(msg.RoutingKey())
-	} else {
-		pattern := strings.Replace(binding.Key, ".", `\.`, -1)
-		pattern = strings.Replace(pattern, "*", `[0-9A-z]+`, -1)
-		pattern = strings.Replace(pattern, `\.#\.`, `(\.|\.[0-9A-z\.]*\.)`, -1)
-		pattern = strings.Replace(pattern, `\.#`, `(\.[0-9A-z\.]*)?`, -1)
-		pattern = strings.Replace(pattern, `#\.`, `([0-9A-z\.]*\.)?`, -1)
-		pattern = strings.Replace(pattern, "#", `[0-9A-z\.]*`, -1)
-
-		matcher := regexp.MustCompile(fmt.Sprintf("^%s$", pattern))
-
-		go func() {
-			patternCache.Lock()
-			defer patternCache.Unlock()
-
-			patternCache.cache[binding.Key] = matcher
-		}()
-
-		return matcher.MatchString(msg.RoutingKey())
-	}
+	return TopicMatches(binding.Key, msg.RoutingKey())
 }
 
 // New returns Matcher implementation that supports comparision through equality
@@ -17,6 +17,10 @@ limitations under the License.
 package matcher_test
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -152,6 +156,23 @@ func TestTopicMatcher(t *testing.T) {
 		{"key.#.extra", "key.anything.0extra", false},
 		{"key.#.extra", "key1.anything.extra", false},
 		{"key.#.extra", "key1.anything.0extra", false},
+
+		// Words are any characters except dot
+		{"*", "key-name", true},
+		{"*.#", "zażółć.key", true},
+		{"*", "", false},
+		{"*.*", "key", false},
+		{"*", "key_name", true},
+		{"key_name", "key_name", true},
+		{"key", "ke_", false},
+		{"#.*.#", "", false},
+		{"#", "", true},
+		{"#.#", "", true},
+		{"*", ".", false},
+		{"*.*", ".", true},
+		{"#.#", "key.extra", true},
+		{"#.*.*.#", "key", false},
+		{"key.#.#.extra.#", "key.a.b.extra.c.extra", true},
 	}
 
 	for i, testCase := range cases {
@@ -167,9 +188,256 @@ func TestTopicMatcher(t *testing.T) {
 				testCase.routingKey,
 				testCase.bindingKey,
 			)
-		} else {
-			// Give a change to build cache
-			time.Sleep(1 * time.Microsecond)
+		}
+
+		index := matcher.Topic.(amq.IndexingMatcher).NewIndex()
+		index.Add(binding)
+
+		if result := len(index.Match(msg)) == 1; result != testCase.expected {
+			t.Errorf(
+				"case: %d; Topic index expected: %t, got: %t, for routing key: %q and binding key: %q",
+				i+1,
+				testCase.expected,
+				result,
+				testCase.routingKey,
+				testCase.bindingKey,
+			)
+		}
+	}
+}
+
+func TestTopicIndex_ReturnsEachMatchingBindingOnce(t *testing.T) {
+	index := matcher.Topic.(amq.IndexingMatcher).NewIndex()
+
+	bindings := map[string]*amq.Binding{}
+	for _, key := range []string{"#", "#.#", "a.#", "#.c", "a.#.c", "*.b.*", "a.b.c", "a.*", "#.b.#.#"} {
+		bindings[key] = &amq.Binding{Key: key}
+		index.Add(bindings[key])
+	}
+
+	seen := make(map[*amq.Binding]int)
+	for _, b := range index.Match(testMsg{routingKey: "a.b.c"}) {
+		seen[b]++
+	}
+
+	for key, b := range bindings {
+		expected := 1
+		if key == "a.*" {
+			expected = 0
+		}
+
+		if seen[b] != expected {
+			t.Errorf("Binding %q matched %d times, expected %d", key, seen[b], expected)
+		}
+	}
+}
+
+func TestTopicIndex_RemoveBinding(t *testing.T) {
+	index := matcher.Topic.(amq.IndexingMatcher).NewIndex()
+
+	b1 := &amq.Binding{Key: "a.*.c"}
+	b2 := &amq.Binding{Key: "a.*.c"}
+	b3 := &amq.Binding{Key: "a.#"}
+
+	index.Add(b1)
+	index.Add(b2)
+	index.Add(b3)
+
+	index.Remove(b1)
+	if bindings := index.Match(testMsg{routingKey: "a.b.c"}); len(bindings) != 2 {
+		t.Errorf("Unexpected number of bindings %d, expected %d", len(bindings), 2)
+	}
+
+	index.Remove(b2)
+	index.Remove(b3)
+	index.Remove(b3)
+	if bindings := index.Match(testMsg{routingKey: "a.b.c"}); len(bindings) != 0 {
+		t.Errorf("Unexpected number of bindings %d, expected %d", len(bindings), 0)
+	}
+}
+
+func TestDirectIndex(t *testing.T) {
+	index := matcher.Direct.(amq.IndexingMatcher).NewIndex()
+
+	b1 := &amq.Binding{Key: "key"}
+	b2 := &amq.Binding{Key: "key"}
+	b3 := &amq.Binding{Key: "other"}
+
+	index.Add(b1)
+	index.Add(b2)
+	index.Add(b3)
+
+	if bindings := index.Match(testMsg{routingKey: "key"}); len(bindings) != 2 {
+		t.Errorf("Unexpected number of bindings %d, expected %d", len(bindings), 2)
+	}
+
+	index.Remove(b1)
+	if bindings := index.Match(testMsg{routingKey: "key"}); len(bindings) != 1 || bindings[0] != b2 {
+		t.Error("Unexpected bindings matched:", bindings)
+	}
+
+	index.Remove(b2)
+	if bindings := index.Match(testMsg{routingKey: "key"}); len(bindings) != 0 {
+		t.Errorf("Unexpected number of bindings %d, expected %d", len(bindings), 0)
+	}
+}
+
+func TestFanoutIndex(t *testing.T) {
+	index := matcher.Fanout.(amq.IndexingMatcher).NewIndex()
+
+	b1 := &amq.Binding{Key: "key"}
+	b2 := &amq.Binding{Key: "other"}
+
+	index.Add(b1)
+	index.Add(b2)
+
+	if bindings := index.Match(testMsg{routingKey: "any"}); len(bindings) != 2 {
+		t.Errorf("Unexpected number of bindings %d, expected %d", len(bindings), 2)
+	}
+
+	index.Remove(b1)
+	if bindings := index.Match(testMsg{}); len(bindings) != 1 || bindings[0] != b2 {
+		t.Error("Unexpected bindings matched:", bindings)
+	}
+}
+
+func TestHeadersMatcher(t *testing.T) {
+	headers := amq.Headers{
+		"format":  "pdf",
+		"type":    []byte("report"),
+		"pages":   int32(10),
+		"ratio":   float64(0.5),
+		"x-trace": "abc",
+		"tags":    []interface{}{"a", int8(1)},
+		"meta":    amq.Headers{"version": uint8(2)},
+	}
+
+	cases := []struct {
+		arguments amq.Headers
+		expected  bool
+	}{
+		// x-match all is the default
+		{amq.Headers{}, true},
+		{amq.Headers{"format": "pdf"}, true},
+		{amq.Headers{"format": "pdf", "type": "report"}, true},
+		{amq.Headers{"format": "pdf", "type": "log"}, false},
+		{amq.Headers{"format": "pdf", "missing": "value"}, false},
+		{amq.Headers{"x-match": "all", "format": "pdf", "pages": 10}, true},
+
+		// x-match any
+		{amq.Headers{"x-match": "any"}, false},
+		{amq.Headers{"x-match": "any", "format": "zip", "type": "report"}, true},
+		{amq.Headers{"x-match": "any", "format": "zip", "type": "log"}, false},
+
+		// Presence check
+		{amq.Headers{"format": nil}, true},
+		{amq.Headers{"missing": nil}, false},
+
+		// x- prefixed arguments
+		{amq.Headers{"x-trace": "other"}, true},
+		{amq.Headers{"x-match": "all-with-x", "x-trace": "other"}, false},
+		{amq.Headers{"x-match": "all-with-x", "x-trace": "abc"}, true},
+		{amq.Headers{"x-match": "any", "x-trace": "abc"}, false},
+		{amq.Headers{"x-match": "any-with-x", "x-trace": "abc", "format": "zip"}, true},
+
+		// Type-aware equality
+		{amq.Headers{"pages": uint64(10)}, true},
+		{amq.Headers{"pages": int64(-10)}, false},
+		{amq.Headers{"pages": float32(10)}, true},
+		{amq.Headers{"pages": "10"}, false},
+		{amq.Headers{"ratio": float32(0.5)}, true},
+		{amq.Headers{"type": []byte("report")}, true},
+		{amq.Headers{"tags": []interface{}{"a", int64(1)}}, true},
+		{amq.Headers{"tags": []interface{}{"a"}}, false},
+		{amq.Headers{"meta": map[string]interface{}{"version": 2}}, true},
+		{amq.Headers{"meta": amq.Headers{"version": 3}}, false},
+	}
+
+	for i, testCase := range cases {
+		msg := testMsg{headers: headers}
+		binding := &amq.Binding{Arguments: testCase.arguments}
+
+		if result := matcher.Headers.Matches(msg, binding); result != testCase.expected {
+			t.Errorf(
+				"case: %d; Headers matcher expected: %t, got: %t, for arguments: %v",
+				i+1,
+				testCase.expected,
+				result,
+				testCase.arguments,
+			)
+		}
+	}
+}
+
+func TestConsistentHashMatcher_RejectsInvalidWeights(t *testing.T) {
+	selector := matcher.ConsistentHash.(amq.SelectingMatcher).NewSelector()
+
+	for _, key := range []string{"", "0", "-1", "weight"} {
+		if err := selector.Add(&amq.Binding{Key: key}); err != matcher.ErrInvalidWeight {
+			t.Errorf("Unexpected error for key %q: %v", key, err)
+		}
+	}
+
+	if selector.Select(testMsg{}) != nil {
+		t.Error("Unexpected binding selected from empty ring")
+	}
+}
+
+func TestConsistentHashMatcher_DistributesByWeight(t *testing.T) {
+	selector := matcher.ConsistentHash.(amq.SelectingMatcher).NewSelector()
+
+	bindings := []*amq.Binding{{Key: "1"}, {Key: "1"}, {Key: "2"}}
+	for _, b := range bindings {
+		if err := selector.Add(b); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+
+	counts := make(map[*amq.Binding]int)
+	for i := 0; i < 10000; i++ {
+		counts[selector.Select(testMsg{routingKey: strconv.Itoa(i)})]++
+	}
+
+	for i, b := range bindings {
+		if counts[b] == 0 {
+			t.Errorf("Binding %d received no messages", i)
+		}
+	}
+
+	if counts[bindings[2]] < counts[bindings[0]] || counts[bindings[2]] < counts[bindings[1]] {
+		t.Error("Unexpected distribution:", counts[bindings[0]], counts[bindings[1]], counts[bindings[2]])
+	}
+}
+
+func TestConsistentHashMatcher_RemovingBindingRemapsOnlyItsMessages(t *testing.T) {
+	selector := matcher.NewConsistentHash("test", matcher.HashHeader("customer")).(amq.SelectingMatcher).NewSelector()
+
+	bindings := []*amq.Binding{{Key: "1"}, {Key: "1"}, {Key: "1"}}
+	for _, b := range bindings {
+		selector.Add(b)
+	}
+
+	msgs := make([]testMsg, 1000)
+	before := make([]*amq.Binding, len(msgs))
+	for i := range msgs {
+		msgs[i] = testMsg{headers: amq.Headers{"customer": i}}
+		before[i] = selector.Select(msgs[i])
+
+		if selector.Select(msgs[i]) != before[i] {
+			t.Fatal("Unexpected binding change for the same message")
+		}
+	}
+
+	selector.Remove(bindings[0])
+
+	for i, msg := range msgs {
+		after := selector.Select(msg)
+		if after == bindings[0] {
+			t.Fatal("Removed binding selected")
+		}
+
+		if before[i] != bindings[0] && after != before[i] {
+			t.Error("Unexpected remapping of message:", i)
 		}
 	}
 }
@@ -203,6 +471,31 @@ func TestMatchers_CanBeCompared(t *testing.T) {
 	}
 }
 
+func TestBrowseFilters(t *testing.T) {
+	msg := testMsg{
+		routingKey: "stock.nyse.ibm",
+		headers:    amq.Headers{"format": "pdf", "type": "report"},
+	}
+	now := time.Now()
+
+	cases := []struct {
+		filter amq.BrowseFilter
+		result bool
+	}{
+		{matcher.TopicFilter("stock.#"), true},
+		{matcher.TopicFilter("stock.*.msft"), false},
+		{matcher.HeadersFilter(amq.Headers{"format": "pdf"}), true},
+		{matcher.HeadersFilter(amq.Headers{"format": "pdf", "type": "log"}), false},
+		{matcher.HeadersFilter(amq.Headers{"x-match": "any", "format": "pdf", "type": "log"}), true},
+	}
+
+	for i, testCase := range cases {
+		if result := testCase.filter(msg, now); result != testCase.result {
+			t.Errorf("case: %d; Unexpected filter result, expected %t, got %t", i+1, testCase.result, result)
+		}
+	}
+}
+
 type testMsg struct {
 	headers    amq.Headers
 	routingKey string
@@ -230,3 +523,87 @@ func (self testMsg) Timestamp() time.Time {
 func (self testMsg) Body() []byte {
 	return self.body
 }
+
+func BenchmarkTopicMatcher_Regex(b *testing.B) {
+	bindings, msgs := topicBenchmarkData()
+	cache := make(map[string]*regexp.Regexp)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := msgs[i%len(msgs)]
+		for _, binding := range bindings {
+			regexTopicMatch(cache, binding.Key, msg.RoutingKey())
+		}
+	}
+}
+
+func BenchmarkTopicMatcher_Words(b *testing.B) {
+	bindings, msgs := topicBenchmarkData()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := msgs[i%len(msgs)]
+		for _, binding := range bindings {
+			matcher.Topic.Matches(msg, binding)
+		}
+	}
+}
+
+func BenchmarkTopicIndex(b *testing.B) {
+	bindings, msgs := topicBenchmarkData()
+
+	index := matcher.Topic.(amq.IndexingMatcher).NewIndex()
+	for _, binding := range bindings {
+		index.Add(binding)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Match(msgs[i%len(msgs)])
+	}
+}
+
+func topicBenchmarkData() ([]*amq.Binding, []testMsg) {
+	var bindings []*amq.Binding
+	for i := 0; i < 1000; i++ {
+		var key string
+		switch i % 4 {
+		case 0:
+			key = fmt.Sprintf("orders.%d.created", i)
+		case 1:
+			key = fmt.Sprintf("orders.*.%d", i)
+		case 2:
+			key = fmt.Sprintf("events.%d.#", i)
+		default:
+			key = fmt.Sprintf("#.%d", i)
+		}
+		bindings = append(bindings, &amq.Binding{Key: key})
+	}
+
+	var msgs []testMsg
+	for i := 0; i < 100; i++ {
+		msgs = append(msgs, testMsg{routingKey: fmt.Sprintf("orders.%d.created", i*10)})
+		msgs = append(msgs, testMsg{routingKey: fmt.Sprintf("events.%d.user.signup", i*10+2)})
+	}
+
+	return bindings, msgs
+}
+
+// regexTopicMatch is the former regular expression based topic matcher,
+// kept for benchmark comparison.
+func regexTopicMatch(cache map[string]*regexp.Regexp, key, routingKey string) bool {
+	matcher, found := cache[key]
+	if !found {
+		pattern := strings.Replace(key, ".", `\.`, -1)
+		pattern = strings.Replace(pattern, "*", `[0-9A-z]+`, -1)
+		pattern = strings.Replace(pattern, `\.#\.`, `(\.|\.[0-9A-z\.]*\.)`, -1)
+		pattern = strings.Replace(pattern, `\.#`, `(\.[0-9A-z\.]*)?`, -1)
+		pattern = strings.Replace(pattern, `#\.`, `([0-9A-z\.]*\.)?`, -1)
+		pattern = strings.Replace(pattern, "#", `[0-9A-z\.]*`, -1)
+
+		matcher = regexp.MustCompile(fmt.Sprintf("^%s$", pattern))
+		cache[key] = matcher
+	}
+
+	return matcher.MatchString(routingKey)
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matcher
+
+import (
+	"strings"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+type topicMatcher struct {
+	*matcherImpl
+}
+
+func (self *topicMatcher) NewIndex() amq.BindingIndex {
+	return &topicIndex{
+		root: newTopicNode(nil, ""),
+	}
+}
+
+// TopicMatches reports whatever routing key matches binding pattern.
+//
+// Both are split into dot-separated words, which may be empty, but empty
+// string has no words at all. Pattern word `*` matches exactly one word, `#`
+// matches zero or more words, other words match only themselves.
+func TopicMatches(pattern, routingKey string) bool {
+	p := topicWords(pattern)
+	w := topicWords(routingKey)
+
+	// Wildcard matching with backtracking to the last `#`, `#` can not
+	// consume more than all remaining words, so this is O(len(p)*len(w))
+	pi, wi := 0, 0
+	hash, resume := -1, 0
+	for wi < len(w) {
+		switch {
+		case pi < len(p) && p[pi] == "#":
+			hash, resume = pi, wi
+			pi++
+
+		case pi < len(p) && (p[pi] == "*" || p[pi] == w[wi]):
+			pi++
+			wi++
+
+		case hash >= 0:
+			// Let the last `#` consume one more word
+			resume++
+			pi, wi = hash+1, resume
+
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == "#" {
+		pi++
+	}
+
+	return pi == len(p)
+}
+
+// topicWords splits routing key or pattern into words, like AMQP brokers
+// do, empty string has no words.
+func topicWords(key string) []string {
+	if key == "" {
+		return nil
+	}
+
+	return strings.Split(key, ".")
+}
+
+// topicIndex is a word-trie of binding patterns, lookup cost is proportional
+// to routing key depth rather than number of bindings.
+type topicIndex struct {
+	root *topicNode
+}
+
+type topicNode struct {
+	parent   *topicNode
+	word     string
+	children map[string]*topicNode
+	bindings []*amq.Binding
+}
+
+func newTopicNode(parent *topicNode, word string) *topicNode {
+	return &topicNode{
+		parent:   parent,
+		word:     word,
+		children: make(map[string]*topicNode),
+	}
+}
+
+func (self *topicIndex) Add(binding *amq.Binding) error {
+	node := self.root
+	for _, word := range topicWords(binding.Key) {
+		child, found := node.children[word]
+		if !found {
+			child = newTopicNode(node, word)
+			node.children[word] = child
+		}
+		node = child
+	}
+
+	node.bindings = append(node.bindings, binding)
+	return nil
+}
+
+func (self *topicIndex) Remove(binding *amq.Binding) {
+	node := self.root
+	for _, word := range topicWords(binding.Key) {
+		if node = node.children[word]; node == nil {
+			return
+		}
+	}
+
+	node.bindings = removeBinding(node.bindings, binding)
+
+	// Prune nodes which lead to no bindings
+	for node.parent != nil && len(node.bindings) == 0 && len(node.children) == 0 {
+		delete(node.parent.children, node.word)
+		node = node.parent
+	}
+}
+
+func (self *topicIndex) Match(msg amq.Message) []*amq.Binding {
+	m := topicMatch{}
+	m.walk(self.root, topicWords(msg.RoutingKey()))
+
+	var bindings []*amq.Binding
+	for _, node := range m.nodes {
+		bindings = append(bindings, node.bindings...)
+	}
+
+	return bindings
+}
+
+type topicMatch struct {
+	nodes []*topicNode
+
+	// walked is used only after `#` node is reached, as only then the same
+	// node may be reached multiple times, with the same remaining words
+	walked map[topicState]struct{}
+}
+
+type topicState struct {
+	node  *topicNode
+	words int
+}
+
+func (self *topicMatch) walk(node *topicNode, words []string) {
+	if self.walked != nil {
+		state := topicState{node, len(words)}
+		if _, found := self.walked[state]; found {
+			return
+		}
+		self.walked[state] = struct{}{}
+	}
+
+	if len(words) == 0 {
+		if len(node.bindings) > 0 {
+			self.nodes = append(self.nodes, node)
+		}
+	} else {
+		if child := node.children[words[0]]; child != nil {
+			self.walk(child, words[1:])
+		}
+
+		if child := node.children["*"]; child != nil {
+			self.walk(child, words[1:])
+		}
+	}
+
+	if child := node.children["#"]; child != nil {
+		if self.walked == nil {
+			// Nodes collected so far were reached once, with no words left
+			self.walked = make(map[topicState]struct{})
+			for _, n := range self.nodes {
+				self.walked[topicState{n, 0}] = struct{}{}
+			}
+		}
+
+		for i := 0; i <= len(words); i++ {
+			self.walk(child, words[i:])
+		}
+	}
+}
+
+// Ensure Topic matcher implements IndexingMatcher interface
+var _ amq.IndexingMatcher = &topicMatcher{}
@@ -0,0 +1,122 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+var ErrHandlerClosed = errors.New("Queue handler: Handler closed")
+
+func init() {
+	// Header values are encoded as interfaces, so gob needs to know
+	// non-basic types in advance
+	gob.Register(amq.Headers{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+}
+
+// messagePayload is encoded form of stored message.
+type messagePayload struct {
+	Headers    amq.Headers
+	RoutingKey string
+	Priority   uint8
+	Timestamp  time.Time
+	Body       []byte
+	Properties amq.Properties
+
+	// Queue metadata, see amq.NewHeldMessage()
+	ExpiresAt   time.Time
+	Redelivered bool
+}
+
+// encodeMessage encodes message stored outside of memory with gob, along with
+// its properties, expiration deadline and redelivered flag set by Queue.
+// Header values of types not registered in init() make encoding fail.
+func encodeMessage(msg amq.Message) ([]byte, error) {
+	p := messagePayload{
+		Headers:    msg.Headers(),
+		RoutingKey: msg.RoutingKey(),
+		Priority:   msg.Priority(),
+		Timestamp:  msg.Timestamp(),
+		Body:       msg.Body(),
+		Properties: amq.PropertiesOf(msg),
+	}
+
+	if e, ok := msg.(amq.ExpiringMessage); ok {
+		p.ExpiresAt = e.ExpiresAt()
+	}
+
+	if r, ok := msg.(amq.RedeliveredMessage); ok {
+		p.Redelivered = r.Redelivered()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&p); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeMessage decodes message encoded by encodeMessage(), it's returned
+// as *amq.BasicMessage, wrapped with Queue metadata if it had any.
+func decodeMessage(data []byte) (amq.Message, error) {
+	var p messagePayload
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return nil, err
+	}
+
+	msg := amq.NewMessageBuilder().
+		Headers(p.Headers).
+		RoutingKey(p.RoutingKey).
+		Priority(p.Priority).
+		Timestamp(p.Timestamp).
+		Body(p.Body).
+		Properties(p.Properties).
+		Build()
+
+	if !p.ExpiresAt.IsZero() || p.Redelivered {
+		return amq.NewHeldMessage(msg, p.ExpiresAt, p.Redelivered), nil
+	}
+
+	return msg, nil
+}
+
+// storageErr is embedded by handlers keeping messages outside of memory,
+// it records the first storage error which could not be returned to caller.
+type storageErr struct {
+	err error
+}
+
+// Err returns the first storage error which could not be returned to caller,
+// or nil.
+func (self *storageErr) Err() error {
+	return self.err
+}
+
+func (self *storageErr) fail(err error) {
+	if self.err == nil {
+		self.err = err
+	}
+}
@@ -25,7 +25,7 @@ import (
 )
 
 func TestQueueHandler_NewHasZeroLength(t *testing.T) {
-	for _, q := range []amq.QueueHandler{NewQueueHandler(), NewPQHandler()} {
+	for _, q := range testHandlers(t) {
 		if q.Len() != 0 {
 			t.Error("Unexpected non-empty queue")
 		}
@@ -34,9 +34,10 @@ func TestQueueHandler_NewHasZeroLength(t *testing.T) {
 
 func TestQueueHandler_PeekOnEmptyQueuePanics(t *testing.T) {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	handlers := testHandlers(t)
+	wg.Add(len(handlers))
 
-	for _, q := range []amq.QueueHandler{NewQueueHandler(), NewPQHandler()} {
+	for _, q := range handlers {
 		go func(q amq.QueueHandler) {
 			defer func() {
 				if err := recover(); err != "queue: Peek() called on empty queue" {
@@ -54,9 +55,10 @@ func TestQueueHandler_PeekOnEmptyQueuePanics(t *testing.T) {
 
 func TestQueueHandler_RemoveFromEmptyQueuePanics(t *testing.T) {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	handlers := testHandlers(t)
+	wg.Add(len(handlers))
 
-	for _, q := range []amq.QueueHandler{NewQueueHandler(), NewPQHandler()} {
+	for _, q := range handlers {
 		go func(q amq.QueueHandler) {
 			defer func() {
 				if err := recover(); err != "queue: Remove() called on empty queue" {
@@ -73,7 +75,7 @@ func TestQueueHandler_RemoveFromEmptyQueuePanics(t *testing.T) {
 }
 
 func TestQueueHandler_QueuesMessages(t *testing.T) {
-	for _, q := range []amq.QueueHandler{NewQueueHandler(), NewPQHandler()} {
+	for _, q := range testHandlers(t) {
 		for i := 0; i < 100; i++ {
 			q.Add(testMsg{})
 		}
@@ -104,57 +106,57 @@ func TestQueueHandler_ReturnMessagesInCorrectOrder(t *testing.T) {
 }
 
 func TestPQHandler_ReturnMessagesInCorrectOrder(t *testing.T) {
-	q := NewPQHandler()
+	for _, q := range priorityTestHandlers(t) {
+		for i := 0; i < 100; i++ {
+			q.Add(testMsg{
+				priority: uint8(i % 10),
+			})
+		}
 
-	for i := 0; i < 100; i++ {
-		q.Add(testMsg{
-			priority: uint8(i % 10),
-		})
-	}
+		for p := 9; p >= 0; p-- {
+			for i := 0; i < 10; i++ {
+				msg := q.Peek()
+				if msg.Priority() != uint8(p) {
+					t.Errorf("Invalid message priority, expected %d got %d", p, msg.Priority())
+				}
 
-	for p := 9; p >= 0; p-- {
-		for i := 0; i < 10; i++ {
-			msg := q.Peek()
-			if msg.Priority() != uint8(p) {
-				t.Errorf("Invalid message priority, expected %d got %d", p, msg.Priority())
+				q.Remove()
 			}
-
-			q.Remove()
 		}
 	}
 }
 
 func TestPQHandler_OrdersMassegesBasedOnTimeWithinSamePriority(t *testing.T) {
-	q := NewPQHandler()
-
-	early := time.Now()
-	time.Sleep(10 * time.Millisecond)
-	late := time.Now()
+	for _, q := range priorityTestHandlers(t) {
+		early := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		late := time.Now()
 
-	q.Add(testMsg{
-		priority:  1,
-		timestamp: late,
-	})
-	q.Add(testMsg{
-		priority:  1,
-		timestamp: early,
-	})
+		q.Add(testMsg{
+			priority:  1,
+			timestamp: late,
+		})
+		q.Add(testMsg{
+			priority:  1,
+			timestamp: early,
+		})
 
-	msg := q.Peek()
-	if msg.Timestamp() != early {
-		t.Error("Invalid order")
-	}
-	q.Remove()
+		msg := q.Peek()
+		if !msg.Timestamp().Equal(early) {
+			t.Error("Invalid order")
+		}
+		q.Remove()
 
-	msg = q.Peek()
-	if msg.Timestamp() != late {
-		t.Error("Invalid order")
+		msg = q.Peek()
+		if !msg.Timestamp().Equal(late) {
+			t.Error("Invalid order")
+		}
+		q.Remove()
 	}
-	q.Remove()
 }
 
 func TestQueueHandler_AfterReturningAllMessagesHasZeroLength(t *testing.T) {
-	for _, q := range []amq.QueueHandler{NewQueueHandler(), NewPQHandler()} {
+	for _, q := range testHandlers(t) {
 		for i := 0; i < 100; i++ {
 			q.Add(testMsg{})
 		}
@@ -216,6 +218,249 @@ func TestQueueHandler_AddRemoveCycle(t *testing.T) {
 	}
 }
 
+func TestPQHandler_RemoveExpired(t *testing.T) {
+	q := NewPQHandler().(amq.ExpiringQueueHandler)
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		q.Add(expiringMsg{
+			testMsg:   testMsg{priority: uint8(i)},
+			expiresAt: now.Add(time.Duration(i%2) * time.Hour),
+		})
+	}
+
+	expired := q.RemoveExpired(now)
+	if len(expired) != 5 {
+		t.Errorf("Unexpected expired count, expected %d got %d", 5, len(expired))
+	}
+	if q.Len() != 5 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 5, q.Len())
+	}
+
+	for p := 9; p > 0; p -= 2 {
+		if msg := q.Peek(); msg.Priority() != uint8(p) {
+			t.Errorf("Invalid message priority, expected %d got %d", p, msg.Priority())
+		}
+		q.Remove()
+	}
+}
+
+func TestQueueHandler_IterateInRemovalOrder(t *testing.T) {
+	for _, q := range testHandlers(t) {
+		for i := 0; i < 10; i++ {
+			q.Add(testMsg{priority: uint8(i)})
+		}
+
+		var iterated []amq.Message
+		q.(amq.IterableQueueHandler).Iterate(func(msg amq.Message) bool {
+			iterated = append(iterated, msg)
+			return len(iterated) < 5
+		})
+
+		if len(iterated) != 5 {
+			t.Errorf("Unexpected iterated count, expected %d got %d", 5, len(iterated))
+		}
+		if q.Len() != 10 {
+			t.Errorf("Unexpected queue length, expected %d got %d", 10, q.Len())
+		}
+
+		for _, msg := range iterated {
+			if head := q.Peek(); msg.Priority() != head.Priority() {
+				t.Errorf("Invalid message priority, expected %d got %d", head.Priority(), msg.Priority())
+			}
+			q.Remove()
+		}
+	}
+}
+
+func TestQueueHandler_AddFront(t *testing.T) {
+	lazy := NewLazyHandler(2, PageSize(1), PageDir(t.TempDir()))
+	defer lazy.Close()
+
+	for _, q := range []amq.FrontQueueHandler{NewQueueHandler().(amq.FrontQueueHandler), lazy} {
+		for i := 2; i < 5; i++ {
+			q.Add(testMsg{priority: uint8(i)})
+		}
+		q.AddFront(testMsg{priority: 1})
+		q.AddFront(testMsg{priority: 0})
+
+		if q.Len() != 5 {
+			t.Errorf("Unexpected queue length, expected %d got %d", 5, q.Len())
+		}
+
+		var iterated []uint8
+		q.(amq.IterableQueueHandler).Iterate(func(msg amq.Message) bool {
+			iterated = append(iterated, msg.Priority())
+			return true
+		})
+
+		for i := 0; i < 5; i++ {
+			if iterated[i] != uint8(i) {
+				t.Errorf("Invalid iterated message priority, expected %d got %d", i, iterated[i])
+			}
+			if msg := q.Peek(); msg.Priority() != uint8(i) {
+				t.Errorf("Invalid message priority, expected %d got %d", i, msg.Priority())
+			}
+			q.Remove()
+		}
+	}
+}
+
+func TestScheduledHandler_HoldsMessagesUntilDue(t *testing.T) {
+	q := NewScheduledHandler(NewQueueHandler()).(amq.ScheduledQueueHandler)
+	now := time.Now()
+
+	for i := 3; i > 0; i-- {
+		q.Add(testMsg{
+			priority: uint8(i),
+			headers:  amq.Headers{"x-not-before": now.Add(time.Duration(i) * time.Hour)},
+		})
+	}
+	q.Add(testMsg{})
+
+	if q.Len() != 1 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 1, q.Len())
+	}
+
+	if due, next := q.Advance(now); len(due) != 0 || next == nil {
+		t.Error("Expected due channel for scheduled messages")
+	}
+	if q.Len() != 1 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 1, q.Len())
+	}
+
+	if due, _ := q.Advance(now.Add(2 * time.Hour)); len(due) != 2 {
+		t.Errorf("Unexpected due messages count, expected %d got %d", 2, len(due))
+	}
+	if q.Len() != 3 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 3, q.Len())
+	}
+
+	for _, p := range []uint8{0, 1, 2} {
+		if msg := q.Peek(); msg.Priority() != p {
+			t.Errorf("Invalid message priority, expected %d got %d", p, msg.Priority())
+		}
+		q.Remove()
+	}
+
+	if _, next := q.Advance(now.Add(3 * time.Hour)); next != nil || q.Len() != 1 {
+		t.Error("Expected all messages to be due")
+	}
+}
+
+func TestScheduledHandler_AdvanceSignalsWhenDue(t *testing.T) {
+	q := NewScheduledHandler(NewQueueHandler()).(amq.ScheduledQueueHandler)
+
+	q.Add(testMsg{
+		headers: amq.Headers{"x-not-before": time.Now().Add(10 * time.Millisecond)},
+	})
+
+	_, next := q.Advance(time.Now())
+	select {
+	case now := <-next:
+		q.Advance(now)
+	case <-time.After(time.Second):
+		t.Fatal("Expected due signal not received")
+	}
+
+	if q.Len() != 1 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 1, q.Len())
+	}
+}
+
+func TestScheduledHandler_ForwardsRemoveExpired(t *testing.T) {
+	if _, ok := NewScheduledHandler(NewQueueHandler()).(amq.ExpiringQueueHandler); ok {
+		t.Error("Unexpected ExpiringQueueHandler for FIFO handler")
+	}
+
+	q, ok := NewScheduledHandler(NewPQHandler()).(amq.ExpiringQueueHandler)
+	if !ok {
+		t.Fatal("Expected ExpiringQueueHandler for PQ handler")
+	}
+
+	now := time.Now()
+	q.Add(expiringMsg{testMsg: testMsg{priority: 1}, expiresAt: now.Add(time.Hour)})
+	q.Add(expiringMsg{expiresAt: now})
+
+	if expired := q.RemoveExpired(now); len(expired) != 1 {
+		t.Errorf("Unexpected expired messages count, expected %d got %d", 1, len(expired))
+	}
+	if q.Len() != 1 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 1, q.Len())
+	}
+}
+
+func TestScheduledHandler_SettlesStoredMessages(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWALHandler(dir)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	q := NewScheduledHandler(wal).(amq.DurableQueueHandler)
+	q.Add(persistentMsg("0").Build())
+	q.Add(persistentMsg("1").Build())
+
+	tag := q.Tag()
+	if tag == 0 {
+		t.Fatal("Expected stored message tag")
+	}
+	q.Remove()
+	q.Settle(tag)
+	closeWAL(t, wal)
+
+	wal = openWAL(t, dir)
+	defer closeWAL(t, wal)
+
+	expectKeys(t, wal, "1")
+}
+
+// testHandlers returns new instance of every handler, for contract tests.
+func testHandlers(t *testing.T) []amq.QueueHandler {
+	wal, err := NewWALHandler(t.TempDir())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	t.Cleanup(func() { wal.Close() })
+
+	lazy := NewLazyHandler(10, PageSize(5), PageDir(t.TempDir()))
+	t.Cleanup(func() { lazy.Close() })
+
+	handlers := []amq.QueueHandler{NewQueueHandler(), NewPQHandler(), wal, lazy}
+	for _, newHandler := range optionalTestHandlers {
+		handlers = append(handlers, newHandler(t))
+	}
+
+	return handlers
+}
+
+// priorityTestHandlers returns new instance of every handler ordering
+// messages by priority, for contract tests.
+func priorityTestHandlers(t *testing.T) []amq.QueueHandler {
+	handlers := []amq.QueueHandler{NewPQHandler()}
+	for _, newHandler := range optionalPriorityTestHandlers {
+		handlers = append(handlers, newHandler(t))
+	}
+
+	return handlers
+}
+
+// optionalTestHandlers and optionalPriorityTestHandlers hold constructors
+// of handlers available only with build tags, for contract tests.
+var (
+	optionalTestHandlers         []func(t *testing.T) amq.QueueHandler
+	optionalPriorityTestHandlers []func(t *testing.T) amq.QueueHandler
+)
+
+type expiringMsg struct {
+	testMsg
+	expiresAt time.Time
+}
+
+func (self expiringMsg) ExpiresAt() time.Time {
+	return self.expiresAt
+}
+
 type testMsg struct {
 	headers    amq.Headers
 	routingKey string
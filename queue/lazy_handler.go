@@ -0,0 +1,367 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/eapache/queue.v1"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+// LazyOption configures LazyHandler, see NewLazyHandler().
+type LazyOption func(*LazyHandler)
+
+// PageSize sets number of messages written to single page file, default page
+// size is equal to memory threshold.
+func PageSize(size int) LazyOption {
+	return func(h *LazyHandler) {
+		h.pageSize = size
+	}
+}
+
+// PageDir sets directory in which page files are created, default is
+// os.TempDir().
+func PageDir(dir string) LazyOption {
+	return func(h *LazyHandler) {
+		h.dir = dir
+	}
+}
+
+// LazyHandler is a FIFO queue handler which keeps bounded window of messages
+// at the front of queue in memory, and pages the rest out to temporary files.
+// Paged out messages are brought back to memory, a page at a time, as messages
+// are removed from the front of queue.
+//
+// At most threshold or page size, whichever is greater, plus page size
+// messages are held in memory, not counting messages added by AddFront(),
+// which are kept in memory. Messages which could not be paged out, like
+// ones with headers which can't be encoded, are kept in memory in their place
+// in queue, following messages are paged out as usual. Messages of page which
+// could not be read back are lost, see Err().
+//
+// LazyHandler is not goroutine-safe, concurrent access is controlled inside
+// high-level Queue type.
+type LazyHandler struct {
+	threshold int
+	pageSize  int
+	dir       string
+
+	// memory holds window at the front of queue, tail holds messages added
+	// after paged out ones, until there is enough of them to fill a page,
+	// front is a stack of messages added in front of memory window
+	memory, tail *queue.Queue
+	front        []amq.Message
+	pages        []lazyPage
+	paged        int
+	storageErr
+}
+
+// lazyPage is a run of paged out messages, written to file at path, or kept
+// in msgs when they could not be written.
+type lazyPage struct {
+	path  string
+	count int
+	msgs  []amq.Message
+}
+
+// NewLazyHandler returns queue handler keeping up to threshold messages
+// in memory, configured with given options.
+func NewLazyHandler(threshold int, opts ...LazyOption) *LazyHandler {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	h := &LazyHandler{
+		threshold: threshold,
+		pageSize:  threshold,
+		dir:       os.TempDir(),
+		memory:    queue.New(),
+		tail:      queue.New(),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.pageSize < 1 {
+		h.pageSize = 1
+	}
+
+	return h
+}
+
+// Add enqueues message, it's paged out when memory window is full.
+func (self *LazyHandler) Add(msg amq.Message) {
+	if self.memory.Length() < self.threshold && len(self.pages) == 0 && self.tail.Length() == 0 {
+		self.memory.Add(msg)
+		return
+	}
+
+	self.tail.Add(msg)
+	if self.tail.Length() >= self.pageSize {
+		self.pageOut()
+	}
+}
+
+// AddFront enqueues message at the front of queue, it's never paged out.
+func (self *LazyHandler) AddFront(msg amq.Message) {
+	self.front = append(self.front, msg)
+}
+
+// Peek returns message at the front of queue.
+//
+// This method panics if the queue is empty.
+func (self *LazyHandler) Peek() amq.Message {
+	if n := len(self.front); n > 0 {
+		return self.front[n-1]
+	}
+
+	return self.memory.Peek().(amq.Message)
+}
+
+// Remove dequeues message at the front of queue, next page is brought back
+// to memory when the window becomes empty.
+//
+// This method panics if the queue is empty.
+func (self *LazyHandler) Remove() {
+	if n := len(self.front); n > 0 {
+		self.front[n-1] = nil
+		self.front = self.front[:n-1]
+		return
+	}
+
+	self.memory.Remove()
+
+	if self.memory.Length() == 0 {
+		self.pageIn()
+	}
+}
+
+// Len returns count of messages in queue, both in memory and paged out.
+func (self *LazyHandler) Len() int {
+	return len(self.front) + self.memory.Length() + self.paged + self.tail.Length()
+}
+
+// InMemory returns number of messages held in memory.
+func (self *LazyHandler) InMemory() int {
+	return self.Len() - self.OnDisk()
+}
+
+// OnDisk returns number of messages paged out to disk.
+func (self *LazyHandler) OnDisk() int {
+	count := 0
+	for _, page := range self.pages {
+		if page.msgs == nil {
+			count += page.count
+		}
+	}
+
+	return count
+}
+
+// Iterate calls fn for every message in queue, from the front, until fn
+// returns false. Paged out messages are read from disk, without bringing them
+// back to memory, messages of page which could not be read are skipped.
+func (self *LazyHandler) Iterate(fn func(amq.Message) bool) {
+	for i := len(self.front) - 1; i >= 0; i-- {
+		if !fn(self.front[i]) {
+			return
+		}
+	}
+
+	for i := 0; i < self.memory.Length(); i++ {
+		if !fn(self.memory.Get(i).(amq.Message)) {
+			return
+		}
+	}
+
+	for _, page := range self.pages {
+		msgs := page.msgs
+		if msgs == nil {
+			var err error
+			if msgs, err = readPage(page.path); err != nil {
+				self.fail(err)
+				continue
+			}
+		}
+
+		for _, msg := range msgs {
+			if !fn(msg) {
+				return
+			}
+		}
+	}
+
+	for i := 0; i < self.tail.Length(); i++ {
+		if !fn(self.tail.Get(i).(amq.Message)) {
+			return
+		}
+	}
+}
+
+// Close removes page files, paged out messages are dropped.
+func (self *LazyHandler) Close() error {
+	for _, page := range self.pages {
+		if page.msgs == nil {
+			if err := os.Remove(page.path); err != nil {
+				self.fail(err)
+			}
+		}
+	}
+
+	self.pages = nil
+	self.paged = 0
+
+	return self.Err()
+}
+
+// pageOut moves messages from tail to new pages. Runs of messages which can
+// be encoded are written to page files, messages which can't be encoded,
+// or runs which could not be written, are kept in memory as separate pages.
+func (self *LazyHandler) pageOut() {
+	var data []byte
+	var run []amq.Message
+	for i := 0; i < self.tail.Length(); i++ {
+		msg := self.tail.Get(i).(amq.Message)
+
+		payload, err := encodeMessage(msg)
+		if err != nil {
+			self.fail(err)
+			self.addPage(data, run)
+			self.addPage(nil, []amq.Message{msg})
+			data, run = nil, nil
+			continue
+		}
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+		data = append(data, size[:]...)
+		data = append(data, payload...)
+		run = append(run, msg)
+	}
+
+	self.addPage(data, run)
+	self.tail = queue.New()
+}
+
+// addPage writes encoded run of messages to new page file, nil data means
+// messages are kept in memory.
+func (self *LazyHandler) addPage(data []byte, msgs []amq.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	page := lazyPage{count: len(msgs), msgs: msgs}
+	if data != nil {
+		if path, err := writePage(self.dir, data); err != nil {
+			self.fail(err)
+		} else {
+			page.path, page.msgs = path, nil
+		}
+	}
+
+	self.pages = append(self.pages, page)
+	self.paged += page.count
+}
+
+// pageIn brings back the oldest page, or messages from tail if there are no
+// pages, to memory.
+func (self *LazyHandler) pageIn() {
+	for len(self.pages) > 0 {
+		page := self.pages[0]
+		self.pages = self.pages[1:]
+		self.paged -= page.count
+
+		msgs := page.msgs
+		if msgs == nil {
+			var err error
+			if msgs, err = readPage(page.path); err == nil {
+				err = os.Remove(page.path)
+			}
+
+			if err != nil {
+				self.fail(err)
+			}
+		}
+
+		for _, msg := range msgs {
+			self.memory.Add(msg)
+		}
+
+		if self.memory.Length() > 0 {
+			return
+		}
+	}
+
+	self.memory, self.tail = self.tail, self.memory
+}
+
+func writePage(dir string, data []byte) (string, error) {
+	file, err := ioutil.TempFile(dir, "paperboymq-page-")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+func readPage(path string) ([]amq.Message, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []amq.Message
+	for len(data) >= 4 {
+		end := 4 + int(binary.BigEndian.Uint32(data))
+		if end > len(data) {
+			break
+		}
+
+		msg, err := decodeMessage(data[4:end])
+		if err != nil {
+			return msgs, err
+		}
+
+		msgs = append(msgs, msg)
+		data = data[end:]
+	}
+
+	return msgs, nil
+}
+
+// Ensure LazyHandler implements IterableQueueHandler and FrontQueueHandler
+// interfaces
+var (
+	_ amq.IterableQueueHandler = &LazyHandler{}
+	_ amq.FrontQueueHandler    = &LazyHandler{}
+)
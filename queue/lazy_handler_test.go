@@ -0,0 +1,205 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+func TestLazyHandler_PagesMessagesAboveThreshold(t *testing.T) {
+	dir := t.TempDir()
+	q := NewLazyHandler(10, PageSize(20), PageDir(dir))
+	defer q.Close()
+
+	for i := 0; i < 100; i++ {
+		q.Add(amq.NewMessageBuilder().
+			RoutingKey(strconv.Itoa(i)).
+			Header("index", i).
+			Build())
+	}
+
+	// 10 messages in memory window, 80 paged out and 10 waiting in memory
+	// for the next page
+	if q.InMemory() != 20 || q.OnDisk() != 80 || q.Len() != 100 {
+		t.Errorf("Unexpected counts, %d in memory and %d on disk", q.InMemory(), q.OnDisk())
+	}
+
+	if n := len(pageFiles(t, dir)); n != 4 {
+		t.Errorf("Unexpected number of page files %d", n)
+	}
+
+	for i := 0; i < 100; i++ {
+		msg := q.Peek()
+		if msg.RoutingKey() != strconv.Itoa(i) || msg.Headers()["index"] != i {
+			t.Fatalf("Invalid message, expected %d got %s", i, msg.RoutingKey())
+		}
+		q.Remove()
+
+		if q.InMemory() > 40 {
+			t.Errorf("Unexpected number of messages in memory %d", q.InMemory())
+		}
+	}
+
+	if q.Len() != 0 || q.OnDisk() != 0 {
+		t.Errorf("Unexpected non-empty queue")
+	}
+
+	if n := len(pageFiles(t, dir)); n != 0 {
+		t.Errorf("Unexpected number of page files %d", n)
+	}
+}
+
+func TestLazyHandler_IteratesOverPagedMessages(t *testing.T) {
+	q := NewLazyHandler(2, PageDir(t.TempDir()))
+	defer q.Close()
+
+	for i := 0; i < 7; i++ {
+		q.Add(testMsg{priority: uint8(i)})
+	}
+
+	var priorities []uint8
+	q.Iterate(func(msg amq.Message) bool {
+		priorities = append(priorities, msg.Priority())
+		return true
+	})
+
+	if len(priorities) != 7 {
+		t.Fatalf("Unexpected iterated count, expected %d got %d", 7, len(priorities))
+	}
+
+	for i, p := range priorities {
+		if p != uint8(i) {
+			t.Errorf("Invalid message priority, expected %d got %d", i, p)
+		}
+	}
+
+	if q.OnDisk() != 4 {
+		t.Errorf("Unexpected number of messages on disk %d", q.OnDisk())
+	}
+}
+
+func TestLazyHandler_CloseRemovesPageFiles(t *testing.T) {
+	dir := t.TempDir()
+	q := NewLazyHandler(1, PageDir(dir))
+
+	for i := 0; i < 10; i++ {
+		q.Add(testMsg{})
+	}
+
+	if err := q.Close(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if n := len(pageFiles(t, dir)); n != 0 {
+		t.Errorf("Unexpected number of page files %d", n)
+	}
+}
+
+func TestLazyHandler_KeepsUnencodableMessagesInMemory(t *testing.T) {
+	q := NewLazyHandler(1, PageSize(2), PageDir(t.TempDir()))
+	defer q.Close()
+
+	for i := 0; i < 7; i++ {
+		builder := amq.NewMessageBuilder().RoutingKey(strconv.Itoa(i))
+		if i == 2 {
+			// Unregistered header value type can't be encoded
+			builder.Header("bad", struct{}{})
+		}
+		q.Add(builder.Build())
+	}
+
+	if q.Err() == nil {
+		t.Error("Expected paging error")
+	}
+
+	if q.OnDisk() != 5 || q.InMemory() != 2 {
+		t.Errorf("Unexpected counts, %d in memory and %d on disk", q.InMemory(), q.OnDisk())
+	}
+
+	for i := 0; i < 7; i++ {
+		if msg := q.Peek(); msg.RoutingKey() != strconv.Itoa(i) {
+			t.Fatalf("Invalid message, expected %d got %s", i, msg.RoutingKey())
+		}
+		q.Remove()
+	}
+}
+
+func TestLazyHandler_RetriesPagingAtNextPage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pages")
+	q := NewLazyHandler(1, PageSize(2), PageDir(dir))
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		q.Add(testMsg{priority: uint8(i)})
+	}
+
+	if q.Err() == nil || q.OnDisk() != 0 {
+		t.Error("Expected paging to fail")
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	for i := 3; i < 5; i++ {
+		q.Add(testMsg{priority: uint8(i)})
+	}
+
+	if q.OnDisk() != 2 || q.InMemory() != 3 {
+		t.Errorf("Unexpected counts, %d in memory and %d on disk", q.InMemory(), q.OnDisk())
+	}
+
+	for i := 0; i < 5; i++ {
+		if msg := q.Peek(); msg.Priority() != uint8(i) {
+			t.Fatalf("Invalid message priority, expected %d got %d", i, msg.Priority())
+		}
+		q.Remove()
+	}
+}
+
+func TestLazyHandler_KeepsQueueMetadata(t *testing.T) {
+	q := NewLazyHandler(1, PageDir(t.TempDir()))
+	defer q.Close()
+
+	expiresAt := time.Now().Add(time.Hour)
+	q.Add(testMsg{})
+	q.Add(amq.NewHeldMessage(amq.NewMessageBuilder().Build(), expiresAt, true))
+	q.Remove()
+
+	if r, ok := q.Peek().(amq.RedeliveredMessage); !ok || !r.Redelivered() {
+		t.Error("Redelivered flag not kept")
+	}
+
+	if e, ok := q.Peek().(amq.ExpiringMessage); !ok || !e.ExpiresAt().Equal(expiresAt) {
+		t.Error("Expiration deadline not kept")
+	}
+}
+
+func pageFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "paperboymq-page-*"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	return files
+}
@@ -18,6 +18,8 @@ package queue
 
 import (
 	"container/heap"
+	"sort"
+	"time"
 
 	"github.com/canni/paperboymq/amq"
 )
@@ -86,3 +88,52 @@ func (self pqHandler) Remove() {
 
 	heap.Pop(self.heapImpl)
 }
+
+// RemoveExpired removes all expired messages, regardless of their position
+// in queue, and returns them.
+func (self pqHandler) RemoveExpired(now time.Time) []amq.Message {
+	var expired []amq.Message
+
+	live := (*self.heapImpl)[:0]
+	for _, msg := range *self.heapImpl {
+		if amq.Expired(msg, now) {
+			expired = append(expired, msg)
+		} else {
+			live = append(live, msg)
+		}
+	}
+
+	if len(expired) > 0 {
+		// Clear references to removed messages
+		tail := (*self.heapImpl)[len(live):]
+		for i := range tail {
+			tail[i] = nil
+		}
+
+		*self.heapImpl = live
+		heap.Init(self.heapImpl)
+	}
+
+	return expired
+}
+
+// Iterate calls fn for every message in queue, in order of removal, until fn
+// returns false.
+func (self pqHandler) Iterate(fn func(amq.Message) bool) {
+	sorted := make(heapImpl, len(*self.heapImpl))
+	copy(sorted, *self.heapImpl)
+	sort.Sort(sorted)
+
+	for _, msg := range sorted {
+		if !fn(msg) {
+			return
+		}
+	}
+}
+
+// Ensure pqHandler implements ExpiringQueueHandler and IterableQueueHandler
+// interfaces
+var (
+	_ amq.ExpiringQueueHandler = pqHandler{}
+	_ amq.IterableQueueHandler = pqHandler{}
+)
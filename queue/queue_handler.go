@@ -22,8 +22,11 @@ import (
 	"github.com/canni/paperboymq/amq"
 )
 
+// queueHandler holds messages added to the front of queue on front stack,
+// top of the stack being the front of queue, followed by messages in q.
 type queueHandler struct {
-	q *queue.Queue
+	q     *queue.Queue
+	front []amq.Message
 }
 
 // NewQueueHandler returns default in-memory message queue implementation.
@@ -31,31 +34,69 @@ type queueHandler struct {
 // Default implementation is not goroutine-safe, concurrent access is controlled
 // inside high-level Queue type.
 func NewQueueHandler() amq.QueueHandler {
-	return queueHandler{
+	return &queueHandler{
 		q: queue.New(),
 	}
 }
 
 // Add enqueues message.
-func (self queueHandler) Add(msg amq.Message) {
+func (self *queueHandler) Add(msg amq.Message) {
 	self.q.Add(msg)
 }
 
+// AddFront enqueues message at the front of queue.
+func (self *queueHandler) AddFront(msg amq.Message) {
+	self.front = append(self.front, msg)
+}
+
 // Peek returns current element at the front of queue.
 //
 // This method panics if the queue is empty.
-func (self queueHandler) Peek() amq.Message {
+func (self *queueHandler) Peek() amq.Message {
+	if n := len(self.front); n > 0 {
+		return self.front[n-1]
+	}
+
 	return self.q.Peek().(amq.Message)
 }
 
 // Remove dequeues element at the front of queue.
 //
 // This method panics if the queue is empty.
-func (self queueHandler) Remove() {
+func (self *queueHandler) Remove() {
+	if n := len(self.front); n > 0 {
+		self.front[n-1] = nil
+		self.front = self.front[:n-1]
+		return
+	}
+
 	self.q.Remove()
 }
 
 // Len obviously returns lenght of queue
-func (self queueHandler) Len() int {
-	return self.q.Length()
+func (self *queueHandler) Len() int {
+	return len(self.front) + self.q.Length()
 }
+
+// Iterate calls fn for every message in queue, from the front, until fn
+// returns false.
+func (self *queueHandler) Iterate(fn func(amq.Message) bool) {
+	for i := len(self.front) - 1; i >= 0; i-- {
+		if !fn(self.front[i]) {
+			return
+		}
+	}
+
+	for i := 0; i < self.q.Length(); i++ {
+		if !fn(self.q.Get(i).(amq.Message)) {
+			return
+		}
+	}
+}
+
+// Ensure queueHandler implements IterableQueueHandler and FrontQueueHandler
+// interfaces
+var (
+	_ amq.IterableQueueHandler = &queueHandler{}
+	_ amq.FrontQueueHandler    = &queueHandler{}
+)
@@ -0,0 +1,223 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+type scheduledMsg struct {
+	msg amq.Message
+	due time.Time
+	seq uint64
+}
+
+type scheduleImpl []scheduledMsg
+
+func (self scheduleImpl) Len() int {
+	return len(self)
+}
+
+func (self scheduleImpl) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self scheduleImpl) Less(i, j int) bool {
+	if self[i].due.Equal(self[j].due) {
+		return self[i].seq < self[j].seq
+	}
+
+	return self[i].due.Before(self[j].due)
+}
+
+func (self *scheduleImpl) Push(v interface{}) {
+	*self = append(*self, v.(scheduledMsg))
+}
+
+func (self *scheduleImpl) Pop() interface{} {
+	old := *self
+	n := len(old)
+	v := old[n-1]
+	old[n-1] = scheduledMsg{}
+	*self = old[:n-1]
+
+	return v
+}
+
+type scheduledHandler struct {
+	amq.QueueHandler
+	schedule scheduleImpl
+	timer    *time.Timer
+	seq      uint64
+}
+
+// NewScheduledHandler returns queue handler holding delayed messages
+// (see amq.NotBefore()) until they're due, messages that are due are passed
+// to given handler, in order of their due time.
+//
+// Scheduled messages are not visible until they're due, so Len() reports only
+// visible messages, Iterate() reports scheduled messages too. RemoveExpired()
+// is available when given handler implements amq.ExpiringQueueHandler, stored
+// messages of amq.DurableQueueHandler are settled in given handler. Scheduled
+// messages are kept in memory only, until they're due.
+func NewScheduledHandler(handler amq.QueueHandler) amq.QueueHandler {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	scheduled := &scheduledHandler{
+		QueueHandler: handler,
+		timer:        timer,
+	}
+
+	if _, ok := handler.(amq.ExpiringQueueHandler); ok {
+		return &expiringScheduledHandler{scheduled}
+	}
+
+	return scheduled
+}
+
+// Add enqueues message, delayed messages are scheduled until they're due,
+// x-delay header is counted from now.
+func (self *scheduledHandler) Add(msg amq.Message) {
+	if !self.scheduled(msg) {
+		self.QueueHandler.Add(msg)
+	}
+}
+
+// AddChecked enqueues message like Add() does, returning error of given
+// handler if it implements amq.CheckedQueueHandler.
+func (self *scheduledHandler) AddChecked(msg amq.Message) error {
+	if self.scheduled(msg) {
+		return nil
+	}
+
+	if checked, ok := self.QueueHandler.(amq.CheckedQueueHandler); ok {
+		return checked.AddChecked(msg)
+	}
+
+	self.QueueHandler.Add(msg)
+	return nil
+}
+
+// scheduled schedules message if it's delayed, and reports whatever it did so.
+func (self *scheduledHandler) scheduled(msg amq.Message) bool {
+	now := time.Now()
+	due := amq.NotBefore(msg, now)
+	if !due.After(now) {
+		return false
+	}
+
+	self.seq++
+	heap.Push(&self.schedule, scheduledMsg{msg: msg, due: due, seq: self.seq})
+	return true
+}
+
+// Tag returns tag of message at the front of queue stored by given handler,
+// or zero if it doesn't implement amq.DurableQueueHandler.
+func (self *scheduledHandler) Tag() uint64 {
+	if durable, ok := self.QueueHandler.(amq.DurableQueueHandler); ok {
+		return durable.Tag()
+	}
+
+	return 0
+}
+
+// Settle settles stored message in given handler.
+func (self *scheduledHandler) Settle(tag uint64) {
+	if durable, ok := self.QueueHandler.(amq.DurableQueueHandler); ok {
+		durable.Settle(tag)
+	}
+}
+
+// Advance makes messages due at given time visible and returns them, along
+// with channel signaled when next scheduled message is due, or nil channel if
+// there is none.
+func (self *scheduledHandler) Advance(now time.Time) ([]amq.Message, <-chan time.Time) {
+	var due []amq.Message
+	for len(self.schedule) > 0 && !self.schedule[0].due.After(now) {
+		msg := heap.Pop(&self.schedule).(scheduledMsg).msg
+		self.QueueHandler.Add(msg)
+		due = append(due, msg)
+	}
+
+	if !self.timer.Stop() {
+		// Drain channel if timer fired, but the signal was not received
+		select {
+		case <-self.timer.C:
+		default:
+		}
+	}
+
+	if len(self.schedule) == 0 {
+		return due, nil
+	}
+
+	self.timer.Reset(self.schedule[0].due.Sub(now))
+	return due, self.timer.C
+}
+
+// Iterate calls fn for every visible message, when wrapped handler supports
+// iteration, followed by scheduled messages in order of their due time,
+// until fn returns false.
+func (self *scheduledHandler) Iterate(fn func(amq.Message) bool) {
+	stopped := false
+	if iterable, ok := self.QueueHandler.(amq.IterableQueueHandler); ok {
+		iterable.Iterate(func(msg amq.Message) bool {
+			stopped = !fn(msg)
+			return !stopped
+		})
+	}
+
+	if stopped {
+		return
+	}
+
+	sorted := make(scheduleImpl, len(self.schedule))
+	copy(sorted, self.schedule)
+	for len(sorted) > 0 {
+		if !fn(heap.Pop(&sorted).(scheduledMsg).msg) {
+			return
+		}
+	}
+}
+
+// expiringScheduledHandler is scheduledHandler wrapping handler capable of
+// removing expired messages, scheduled messages never expire as their TTL is
+// counted from the time they're due.
+type expiringScheduledHandler struct {
+	*scheduledHandler
+}
+
+// RemoveExpired removes and returns visible messages expired at given time.
+func (self *expiringScheduledHandler) RemoveExpired(now time.Time) []amq.Message {
+	return self.QueueHandler.(amq.ExpiringQueueHandler).RemoveExpired(now)
+}
+
+// Ensure scheduledHandler implements ScheduledQueueHandler,
+// IterableQueueHandler, DurableQueueHandler and CheckedQueueHandler interfaces,
+// and expiringScheduledHandler implements ExpiringQueueHandler interface too
+var (
+	_ amq.ScheduledQueueHandler = &scheduledHandler{}
+	_ amq.IterableQueueHandler  = &scheduledHandler{}
+	_ amq.DurableQueueHandler   = &scheduledHandler{}
+	_ amq.CheckedQueueHandler   = &scheduledHandler{}
+	_ amq.ExpiringQueueHandler  = &expiringScheduledHandler{}
+	_ amq.ScheduledQueueHandler = &expiringScheduledHandler{}
+)
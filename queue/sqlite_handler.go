@@ -0,0 +1,338 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"database/sql"
+	"time"
+
+	// Pure-Go SQLite driver, registered as "sqlite"
+	_ "modernc.org/sqlite"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	queue         TEXT    NOT NULL,
+	routing_key   TEXT    NOT NULL,
+	priority      INTEGER NOT NULL,
+	timestamp     INTEGER NOT NULL,
+	delivery_mode INTEGER NOT NULL,
+	message_id    TEXT    NOT NULL,
+	body          BLOB,
+	payload       BLOB    NOT NULL,
+	inflight      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS messages_fifo ON messages (queue, inflight, id);
+CREATE INDEX IF NOT EXISTS messages_priority ON messages (queue, inflight, priority DESC, timestamp, id);
+`
+
+// SQLiteOption configures SQLiteHandler, see NewSQLiteHandler().
+type SQLiteOption func(*SQLiteHandler)
+
+// SQLiteQueueName sets name under which messages are stored, so multiple
+// queues can share single database file, default name is empty.
+func SQLiteQueueName(name string) SQLiteOption {
+	return func(h *SQLiteHandler) {
+		h.name = name
+	}
+}
+
+// SQLitePriority makes SQLiteHandler order messages like NewPQHandler() does,
+// by priority and then by timestamp, default order is FIFO.
+func SQLitePriority() SQLiteOption {
+	return func(h *SQLiteHandler) {
+		h.order = "priority DESC, timestamp, id"
+	}
+}
+
+// SQLiteHandler is a durable queue handler, which stores messages in SQLite
+// database file, using pure-Go driver. Messages are kept in messages table,
+// so they can be inspected with ordinary SQL tooling, both FIFO and priority
+// orders are served by indexes.
+//
+// Message removed from queue is marked in-flight, and it's deleted once it's
+// settled, see amq.DurableQueueHandler. In-flight messages are queued again
+// when database is opened again.
+//
+// Database error makes handler failed: it reports no messages and rejects new
+// ones, see Err(). Messages left in database are brought back when it's
+// opened again.
+//
+// Only SQLiteHandler has access to database while it's open, it's not
+// goroutine-safe, concurrent access is controlled inside high-level Queue type.
+// SQLiteHandler is available with sqlite build tag.
+type SQLiteHandler struct {
+	db    *sql.DB
+	name  string
+	order string
+	count int
+	storageErr
+
+	// head caches message at the front of queue, until it's changed
+	head   amq.Message
+	headId int64
+}
+
+// NewSQLiteHandler opens SQLite database file at given path, creating it
+// if needed, and returns handler holding messages stored in it.
+func NewSQLiteHandler(path string, opts ...SQLiteOption) (*SQLiteHandler, error) {
+	h := &SQLiteHandler{
+		order: "id",
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Single connection keeps pragmas, and serializes access like Queue does
+	db.SetMaxOpenConns(1)
+	h.db = db
+
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = FULL", sqliteSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// Messages taken, but not settled before handler was closed, are queued
+	// again
+	if _, err := db.Exec("UPDATE messages SET inflight = 0 WHERE queue = ? AND inflight = 1", h.name); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE queue = ?", h.name).Scan(&h.count); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Add stores message like AddChecked() does, but message which could not be
+// stored is dropped.
+func (self *SQLiteHandler) Add(msg amq.Message) {
+	self.AddChecked(msg)
+}
+
+// AddChecked stores message, and returns error if it could not be stored.
+func (self *SQLiteHandler) AddChecked(msg amq.Message) error {
+	if err := self.Err(); err != nil {
+		return err
+	}
+
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	props := amq.PropertiesOf(msg)
+	_, err = self.db.Exec(
+		`INSERT INTO messages (queue, routing_key, priority, timestamp, delivery_mode, message_id, body, payload)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		self.name,
+		msg.RoutingKey(),
+		msg.Priority(),
+		sqliteTimestamp(msg.Timestamp()),
+		props.DeliveryMode,
+		props.MessageId,
+		msg.Body(),
+		payload,
+	)
+	if err != nil {
+		self.fail(err)
+		return err
+	}
+
+	self.count++
+
+	// New message may take the front of queue in priority order
+	if self.order != "id" {
+		self.head = nil
+	}
+
+	return nil
+}
+
+// Peek returns message at the front of queue.
+//
+// This method panics if the queue is empty, see Len().
+func (self *SQLiteHandler) Peek() amq.Message {
+	if self.Len() == 0 {
+		panic("queue: Peek() called on empty queue")
+	}
+
+	return self.head
+}
+
+// Remove marks message at the front of queue in-flight, stored message
+// stays in database until it's settled. Handler fails if that's not possible,
+// so the message is not served again.
+//
+// This method panics if the queue is empty, see Len().
+func (self *SQLiteHandler) Remove() {
+	if self.Len() == 0 {
+		panic("queue: Remove() called on empty queue")
+	}
+
+	if _, err := self.db.Exec("UPDATE messages SET inflight = 1 WHERE id = ?", self.headId); err != nil {
+		self.fail(err)
+		return
+	}
+
+	self.count--
+	self.head = nil
+}
+
+// Tag returns id of message at the front of queue.
+//
+// This method panics if the queue is empty, see Len().
+func (self *SQLiteHandler) Tag() uint64 {
+	if self.Len() == 0 {
+		panic("queue: Tag() called on empty queue")
+	}
+
+	return uint64(self.headId)
+}
+
+// Settle deletes in-flight message with given id. Message is queued again
+// after restart if it could not be deleted, handler fails in such case.
+func (self *SQLiteHandler) Settle(tag uint64) {
+	if self.Err() != nil {
+		return
+	}
+
+	if _, err := self.db.Exec("DELETE FROM messages WHERE id = ?", int64(tag)); err != nil {
+		self.fail(err)
+	}
+}
+
+// Len returns count of stored messages, not counting in-flight ones, failed
+// handler reports none.
+// Message at the front of queue is loaded here, handler fails if that's
+// not possible.
+func (self *SQLiteHandler) Len() int {
+	if self.Err() != nil || self.count == 0 {
+		return 0
+	}
+
+	if err := self.front(); err != nil {
+		self.fail(err)
+		return 0
+	}
+
+	return self.count
+}
+
+// Iterate calls fn for every message in queue, from the front, until fn
+// returns false. Messages are read while fn is called, so fn must not call
+// other handler methods.
+func (self *SQLiteHandler) Iterate(fn func(amq.Message) bool) {
+	rows, err := self.db.Query("SELECT payload FROM messages WHERE queue = ? AND inflight = 0 ORDER BY "+self.order, self.name)
+	if err != nil {
+		self.fail(err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var payload []byte
+		if err := rows.Scan(&payload); err != nil {
+			self.fail(err)
+			return
+		}
+
+		msg, err := decodeMessage(payload)
+		if err != nil {
+			self.fail(err)
+			return
+		}
+
+		if !fn(msg) {
+			return
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		self.fail(err)
+	}
+}
+
+// Close closes database, and returns error which made handler failed, if any.
+func (self *SQLiteHandler) Close() error {
+	if err := self.db.Close(); err != nil {
+		self.fail(err)
+	}
+
+	return self.Err()
+}
+
+// front loads message at the front of queue from database, unless it's
+// already cached.
+func (self *SQLiteHandler) front() error {
+	if self.head != nil {
+		return nil
+	}
+
+	var id int64
+	var payload []byte
+	err := self.db.QueryRow(
+		"SELECT id, payload FROM messages WHERE queue = ? AND inflight = 0 ORDER BY "+self.order+" LIMIT 1",
+		self.name,
+	).Scan(&id, &payload)
+	if err != nil {
+		return err
+	}
+
+	msg, err := decodeMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	self.head, self.headId = msg, id
+	return nil
+}
+
+// sqliteTimestamp returns timestamp column value, zero time is stored as 0,
+// as it can't be represented in nanoseconds.
+func sqliteTimestamp(timestamp time.Time) int64 {
+	if timestamp.IsZero() {
+		return 0
+	}
+
+	return timestamp.UnixNano()
+}
+
+// Ensure SQLiteHandler implements IterableQueueHandler, CheckedQueueHandler
+// and DurableQueueHandler interfaces
+var (
+	_ amq.IterableQueueHandler = &SQLiteHandler{}
+	_ amq.CheckedQueueHandler  = &SQLiteHandler{}
+	_ amq.DurableQueueHandler  = &SQLiteHandler{}
+)
@@ -0,0 +1,165 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+func init() {
+	optionalTestHandlers = append(optionalTestHandlers, func(t *testing.T) amq.QueueHandler {
+		return openSQLite(t, filepath.Join(t.TempDir(), "queue.db"))
+	})
+	optionalPriorityTestHandlers = append(optionalPriorityTestHandlers, func(t *testing.T) amq.QueueHandler {
+		return openSQLite(t, filepath.Join(t.TempDir(), "queue.db"), SQLitePriority())
+	})
+}
+
+func TestSQLiteHandler_RecoversStoredMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	q := openSQLite(t, path)
+	for i := 0; i < 10; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+	settleFront(q)
+	closeSQLite(t, q)
+
+	q = openSQLite(t, path)
+	defer closeSQLite(t, q)
+
+	expectKeys(t, q, "1", "2", "3", "4", "5", "6", "7", "8", "9")
+}
+
+func TestSQLiteHandler_RecoversUnsettledMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := openSQLite(t, path)
+
+	for i := 0; i < 3; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+
+	tag := q.Tag()
+	q.Remove()
+	q.Remove()
+	q.Settle(tag)
+
+	if q.Len() != 1 {
+		t.Errorf("Unexpected queue length, expected %d got %d", 1, q.Len())
+	}
+	closeSQLite(t, q)
+
+	q = openSQLite(t, path)
+	defer closeSQLite(t, q)
+
+	expectKeys(t, q, "1", "2")
+}
+
+func TestSQLiteHandler_QueuesShareDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	q := openSQLite(t, path, SQLiteQueueName("first"))
+	q.Add(persistentMsg("first").Build())
+	closeSQLite(t, q)
+
+	q = openSQLite(t, path, SQLiteQueueName("second"))
+	q.Add(persistentMsg("second").Build())
+	closeSQLite(t, q)
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE routing_key = 'first'").Scan(&count); err != nil || count != 1 {
+		t.Error("Unexpected stored messages:", count, err)
+	}
+
+	q = openSQLite(t, path, SQLiteQueueName("second"))
+	defer closeSQLite(t, q)
+
+	expectKeys(t, q, "second")
+}
+
+func TestSQLiteHandler_FailsOnDatabaseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	q := openSQLite(t, path)
+	q.Add(persistentMsg("0").Build())
+	q.Add(persistentMsg("1").Build())
+
+	if msg := q.Peek(); msg.RoutingKey() != "0" {
+		t.Error("Unexpected message:", msg.RoutingKey())
+	}
+
+	q.db.Close()
+	q.Remove()
+
+	if q.Err() == nil || q.Len() != 0 {
+		t.Error("Expected failed handler")
+	}
+
+	if err := q.AddChecked(persistentMsg("2").Build()); err != q.Err() {
+		t.Error("Unexpected error:", err)
+	}
+
+	q = openSQLite(t, path)
+	defer closeSQLite(t, q)
+
+	expectKeys(t, q, "0", "1")
+}
+
+func TestSQLiteHandler_ReportsNoMessagesWhenFrontCantBeLoaded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	q := openSQLite(t, path)
+	q.Add(persistentMsg("0").Build())
+	closeSQLite(t, q)
+
+	q = openSQLite(t, path)
+	q.db.Close()
+
+	if q.Len() != 0 || q.Err() == nil {
+		t.Error("Expected failed handler")
+	}
+}
+
+func openSQLite(t *testing.T, path string, opts ...SQLiteOption) *SQLiteHandler {
+	q, err := NewSQLiteHandler(path, opts...)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	return q
+}
+
+func closeSQLite(t *testing.T, q *SQLiteHandler) {
+	if err := q.Close(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,607 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/eapache/queue.v1"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+var ErrCorruptLog = errors.New("WAL handler: Corrupt log segment")
+
+const (
+	defaultSegmentSize = 16 << 20
+
+	walSegmentExt = ".wal"
+
+	// Record header: payload length, checksum, kind and sequence number
+	walHeaderSize = 4 + 4 + 1 + 8
+
+	walRecordAdd    byte = 1
+	walRecordRemove byte = 2
+)
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WALOption configures WALHandler, see NewWALHandler().
+type WALOption func(*WALHandler)
+
+// SegmentSize sets size in bytes after which log segment is sealed and new
+// one is started, default size is 16MB.
+func SegmentSize(size int64) WALOption {
+	return func(h *WALHandler) {
+		h.segmentSize = size
+	}
+}
+
+// SyncEvery makes WALHandler fsync log after every n records, default is
+// to sync after every record. Zero disables syncing, except for sealing
+// segments and closing, so log is left to survive process crashes only.
+func SyncEvery(n int) WALOption {
+	return func(h *WALHandler) {
+		h.syncEvery = n
+	}
+}
+
+// WALHandler is a durable FIFO queue handler, which keeps messages in memory
+// and appends records of persistent messages (with delivery mode
+// amq.Persistent) to write-ahead log, transient messages are not logged.
+//
+// Message is logged when it's added, and its removal is logged once Queue
+// settles it (see amq.DurableQueueHandler), so messages delivered to consumers
+// are recovered after a crash, unless they were acknowledged. Messages left
+// in Queue on close stay logged too.
+//
+// Log is split into segments, each record is checksummed. Sealed segments
+// are compacted from the oldest one: segment is deleted once all its messages
+// are settled, or when at most half of its records are still needed, after
+// rewriting messages left in it to the active segment.
+//
+// Persistent message which could not be logged is rejected by AddChecked(),
+// other messages are still logged. Failed sync, or failure to undo partially
+// written record, breaks the log, since then every persistent message
+// is rejected, see Err().
+//
+// WALHandler is not goroutine-safe, concurrent access is controlled inside
+// high-level Queue type.
+type WALHandler struct {
+	storageErr
+	dir         string
+	segmentSize int64
+	syncEvery   int
+
+	entries *queue.Queue
+	// detached holds logged messages removed from queue, until they're settled
+	detached map[uint64]*walEntry
+	segments []*walSegment
+	active   *os.File
+	seq      uint64
+	unsynced int
+	closed   bool
+}
+
+type walSegment struct {
+	id   uint64
+	path string
+	size int64
+
+	// records is a count of all records, live is a count of logged messages
+	// which are not settled yet
+	records, live int
+}
+
+type walEntry struct {
+	msg amq.Message
+	seq uint64
+
+	// segment holding add record, nil for messages which are not logged
+	segment *walSegment
+}
+
+// NewWALHandler opens write-ahead log in given directory, creating it
+// if needed, and returns handler holding messages recovered from the log.
+//
+// Torn record at the end of the last segment, left by a crash, is truncated.
+// If any other record is damaged the returned error will be of type:
+// ErrCorruptLog
+func NewWALHandler(dir string, opts ...WALOption) (*WALHandler, error) {
+	h := &WALHandler{
+		dir:         dir,
+		segmentSize: defaultSegmentSize,
+		syncEvery:   1,
+		entries:     queue.New(),
+		detached:    make(map[uint64]*walEntry),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := h.recover(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Add enqueues message like AddChecked() does, but message which could not
+// be logged is kept in memory only.
+func (self *WALHandler) Add(msg amq.Message) {
+	if self.AddChecked(msg) != nil {
+		self.entries.Add(&walEntry{msg: msg})
+	}
+}
+
+// AddChecked enqueues message, persistent message is enqueued only after it's
+// appended to log.
+//
+// If handler is closed the returned error will be of type: ErrHandlerClosed
+func (self *WALHandler) AddChecked(msg amq.Message) error {
+	entry := &walEntry{msg: msg}
+
+	if amq.PropertiesOf(msg).DeliveryMode == amq.Persistent {
+		payload, err := encodeMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		segment, err := self.append(walRecordAdd, self.seq+1, payload)
+		if err != nil {
+			return err
+		}
+
+		self.seq++
+		entry.seq = self.seq
+		entry.segment = segment
+	}
+
+	self.entries.Add(entry)
+	return nil
+}
+
+// Peek returns message at the front of queue.
+//
+// This method panics if the queue is empty.
+func (self *WALHandler) Peek() amq.Message {
+	return self.entries.Peek().(*walEntry).msg
+}
+
+// Remove dequeues message at the front of queue, logged message stays
+// in log until it's settled.
+//
+// This method panics if the queue is empty.
+func (self *WALHandler) Remove() {
+	entry := self.entries.Remove().(*walEntry)
+
+	if entry.segment != nil {
+		self.detached[entry.seq] = entry
+	}
+}
+
+// Tag returns sequence number of message at the front of queue, or zero
+// if message is not logged.
+//
+// This method panics if the queue is empty.
+func (self *WALHandler) Tag() uint64 {
+	if entry := self.entries.Peek().(*walEntry); entry.segment != nil {
+		return entry.seq
+	}
+
+	return 0
+}
+
+// Settle appends removal of dequeued message with given sequence number
+// to log. Message is recovered again if its removal could not be logged.
+func (self *WALHandler) Settle(tag uint64) {
+	entry, found := self.detached[tag]
+	if !found {
+		return
+	}
+
+	delete(self.detached, tag)
+	entry.segment.live--
+
+	// Failure is reported by Err() if it breaks the log, otherwise it only
+	// makes message to be delivered again after restart
+	self.append(walRecordRemove, tag, nil)
+}
+
+// Len returns count of messages in queue, dequeued messages which are not
+// settled yet are not counted.
+func (self *WALHandler) Len() int {
+	return self.entries.Length()
+}
+
+// Iterate calls fn for every message in queue, from the front, until fn
+// returns false.
+func (self *WALHandler) Iterate(fn func(amq.Message) bool) {
+	for i := 0; i < self.entries.Length(); i++ {
+		if !fn(self.entries.Get(i).(*walEntry).msg) {
+			return
+		}
+	}
+}
+
+// Close syncs and closes log, and returns error which broke it, if any.
+// Handler keeps messages in memory only after it's closed.
+func (self *WALHandler) Close() error {
+	if self.closed {
+		return self.Err()
+	}
+	self.closed = true
+
+	if self.active != nil {
+		if self.Err() == nil {
+			if err := self.active.Sync(); err != nil {
+				self.fail(err)
+			}
+		}
+
+		if err := self.active.Close(); err != nil {
+			self.fail(err)
+		}
+		self.active = nil
+	}
+
+	return self.Err()
+}
+
+// append writes record to log, sealing active segment first if it's full,
+// and returns segment holding the record.
+func (self *WALHandler) append(kind byte, seq uint64, payload []byte) (*walSegment, error) {
+	if self.closed {
+		return nil, ErrHandlerClosed
+	}
+
+	if err := self.Err(); err != nil {
+		return nil, err
+	}
+
+	if self.active == nil || self.segments[len(self.segments)-1].size >= self.segmentSize {
+		if err := self.roll(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := self.write(kind, seq, payload); err != nil {
+		return nil, err
+	}
+
+	return self.segments[len(self.segments)-1], nil
+}
+
+// write writes record to active segment, syncing it when needed. Partially
+// written record is truncated, the log is broken if that fails, or if sync
+// fails.
+func (self *WALHandler) write(kind byte, seq uint64, payload []byte) error {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	record[8] = kind
+	binary.BigEndian.PutUint64(record[9:], seq)
+	copy(record[walHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(record[8:], walChecksumTable))
+
+	segment := self.segments[len(self.segments)-1]
+	if _, err := self.active.Write(record); err != nil {
+		if terr := self.active.Truncate(segment.size); terr != nil {
+			self.fail(terr)
+		}
+
+		return err
+	}
+
+	segment.size += int64(len(record))
+	segment.records++
+	if kind == walRecordAdd {
+		segment.live++
+	}
+
+	self.unsynced++
+	if self.syncEvery > 0 && self.unsynced >= self.syncEvery {
+		return self.sync()
+	}
+
+	return nil
+}
+
+// sync flushes active segment to disk, the log is broken if that fails,
+// as it's unknown which records survived.
+func (self *WALHandler) sync() error {
+	self.unsynced = 0
+	if err := self.active.Sync(); err != nil {
+		self.fail(err)
+		return err
+	}
+
+	return nil
+}
+
+// roll seals active segment, starts new one and compacts sealed segments.
+// Active segment is missing when starting it failed previously.
+func (self *WALHandler) roll() error {
+	if self.active != nil {
+		if err := self.sync(); err != nil {
+			return err
+		}
+
+		err := self.active.Close()
+		self.active = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := self.create(self.segments[len(self.segments)-1].id + 1); err != nil {
+		return err
+	}
+
+	return self.compact()
+}
+
+// create starts new active segment with given id.
+func (self *WALHandler) create(id uint64) error {
+	path := filepath.Join(self.dir, fmt.Sprintf("%016x%s", id, walSegmentExt))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	self.active = file
+	self.segments = append(self.segments, &walSegment{id: id, path: path})
+
+	return syncDir(self.dir)
+}
+
+// compact deletes sealed segments, starting from the oldest one, while all
+// their messages are settled, or add records of messages left make at most
+// half of their records, in which case those messages are rewritten to active
+// segment first. Remove records of the oldest segment are never needed.
+//
+// Only the oldest segments are deleted, so no remove record is lost while
+// its add record is still present in log.
+func (self *WALHandler) compact() error {
+	for len(self.segments) > 1 {
+		oldest := self.segments[0]
+
+		if oldest.live > 0 {
+			if oldest.live*2 > oldest.records {
+				break
+			}
+
+			if err := self.rewrite(oldest); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Remove(oldest.path); err != nil {
+			return err
+		}
+		self.segments = self.segments[1:]
+
+		if err := syncDir(self.dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrite appends add records of messages held in segment to active segment,
+// keeping their sequence numbers. Dequeued messages which are not settled
+// yet are rewritten too.
+func (self *WALHandler) rewrite(segment *walSegment) error {
+	active := self.segments[len(self.segments)-1]
+
+	entries := make([]*walEntry, 0, segment.live)
+	for i := 0; i < self.entries.Length(); i++ {
+		if entry := self.entries.Get(i).(*walEntry); entry.segment == segment {
+			entries = append(entries, entry)
+		}
+	}
+	for _, entry := range self.detached {
+		if entry.segment == segment {
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		payload, err := encodeMessage(entry.msg)
+		if err != nil {
+			return err
+		}
+
+		if err := self.write(walRecordAdd, entry.seq, payload); err != nil {
+			return err
+		}
+
+		segment.live--
+		entry.segment = active
+	}
+
+	// Rewritten records have to be durable before segment is deleted
+	return self.sync()
+}
+
+// recover rebuilds handler state from log segments.
+func (self *WALHandler) recover() error {
+	paths, err := filepath.Glob(filepath.Join(self.dir, "*"+walSegmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	live := make(map[uint64]*walEntry)
+	for i, path := range paths {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), walSegmentExt), 16, 64)
+		if err != nil {
+			return ErrCorruptLog
+		}
+
+		segment := &walSegment{id: id, path: path}
+		torn, err := self.replay(segment, live)
+		if err != nil {
+			return err
+		}
+
+		if torn {
+			if i != len(paths)-1 {
+				return ErrCorruptLog
+			}
+
+			if err := os.Truncate(path, segment.size); err != nil {
+				return err
+			}
+		}
+
+		self.segments = append(self.segments, segment)
+	}
+
+	entries := make([]*walEntry, 0, len(live))
+	for _, entry := range live {
+		entries = append(entries, entry)
+	}
+	sort.Sort(walEntriesBySeq(entries))
+
+	for _, entry := range entries {
+		self.entries.Add(entry)
+	}
+
+	if n := len(self.segments); n > 0 && self.segments[n-1].size < self.segmentSize {
+		last := self.segments[n-1]
+		if self.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	} else {
+		var id uint64
+		if n > 0 {
+			id = self.segments[n-1].id + 1
+		}
+
+		if err := self.create(id); err != nil {
+			return err
+		}
+	}
+
+	return self.compact()
+}
+
+// replay applies records of segment to live messages, and reports whatever
+// segment ends with torn record, segment size is set to the size of valid
+// records.
+func (self *WALHandler) replay(segment *walSegment, live map[uint64]*walEntry) (bool, error) {
+	data, err := ioutil.ReadFile(segment.path)
+	if err != nil {
+		return false, err
+	}
+
+	for len(data) > 0 {
+		if len(data) < walHeaderSize {
+			return true, nil
+		}
+
+		end := walHeaderSize + int(binary.BigEndian.Uint32(data[0:]))
+		if end > len(data) || binary.BigEndian.Uint32(data[4:]) != crc32.Checksum(data[8:end], walChecksumTable) {
+			return true, nil
+		}
+
+		seq := binary.BigEndian.Uint64(data[9:])
+		switch data[8] {
+		case walRecordAdd:
+			msg, err := decodeMessage(data[walHeaderSize:end])
+			if err != nil {
+				return false, ErrCorruptLog
+			}
+
+			// Message rewritten by compaction, before the old segment
+			// was deleted
+			if entry, found := live[seq]; found {
+				entry.segment.live--
+			}
+
+			live[seq] = &walEntry{msg: msg, seq: seq, segment: segment}
+			segment.live++
+
+		case walRecordRemove:
+			if entry, found := live[seq]; found {
+				entry.segment.live--
+				delete(live, seq)
+			}
+
+		default:
+			return false, ErrCorruptLog
+		}
+
+		if seq > self.seq {
+			self.seq = seq
+		}
+
+		segment.size += int64(end)
+		segment.records++
+		data = data[end:]
+	}
+
+	return false, nil
+}
+
+type walEntriesBySeq []*walEntry
+
+func (self walEntriesBySeq) Len() int {
+	return len(self)
+}
+
+func (self walEntriesBySeq) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self walEntriesBySeq) Less(i, j int) bool {
+	return self[i].seq < self[j].seq
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// Ensure WALHandler implements IterableQueueHandler, DurableQueueHandler
+// and CheckedQueueHandler interfaces
+var (
+	_ amq.IterableQueueHandler = &WALHandler{}
+	_ amq.DurableQueueHandler  = &WALHandler{}
+	_ amq.CheckedQueueHandler  = &WALHandler{}
+)
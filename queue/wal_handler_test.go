@@ -0,0 +1,291 @@
+/*
+Copyright 2015 Dariusz Górecki <darek.krk@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/canni/paperboymq/amq"
+)
+
+func TestWALHandler_RecoversPersistentMessages(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir)
+
+	for i := 0; i < 10; i++ {
+		mode := amq.Persistent
+		if i%2 == 1 {
+			mode = amq.Transient
+		}
+
+		q.Add(persistentMsg(strconv.Itoa(i)).DeliveryMode(mode).Build())
+	}
+
+	settleFront(q)
+	closeWAL(t, q)
+
+	q = openWAL(t, dir)
+	defer closeWAL(t, q)
+
+	expectKeys(t, q, "2", "4", "6", "8")
+}
+
+func TestWALHandler_RecoversUnsettledMessages(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir)
+
+	for i := 0; i < 3; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+
+	tag := q.Tag()
+	q.Remove()
+	q.Remove()
+	q.Settle(tag)
+	closeWAL(t, q)
+
+	q = openWAL(t, dir)
+	defer closeWAL(t, q)
+
+	expectKeys(t, q, "1", "2")
+}
+
+func TestWALHandler_RejectsMessagesAfterClose(t *testing.T) {
+	q := openWAL(t, t.TempDir())
+	closeWAL(t, q)
+
+	if err := q.AddChecked(persistentMsg("0").Build()); err != ErrHandlerClosed {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := q.AddChecked(persistentMsg("1").DeliveryMode(amq.Transient).Build()); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	expectKeys(t, q, "1")
+}
+
+func TestWALHandler_RecoversExpirationDeadline(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir)
+
+	expiresAt := time.Now().Add(time.Hour)
+	q.Add(expiringMsg{
+		testMsg:   testMsg{},
+		expiresAt: expiresAt,
+	})
+	q.Add(walTestMsg{persistentMsg("expiring").Build(), expiresAt})
+	closeWAL(t, q)
+
+	q = openWAL(t, dir)
+	defer closeWAL(t, q)
+
+	if q.Len() != 1 {
+		t.Fatalf("Unexpected queue length, expected %d got %d", 1, q.Len())
+	}
+
+	if e, ok := q.Peek().(amq.ExpiringMessage); !ok || !e.ExpiresAt().Equal(expiresAt) {
+		t.Error("Expiration deadline not recovered")
+	}
+}
+
+func TestWALHandler_TruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir)
+
+	q.Add(persistentMsg("0").Build())
+	q.Add(persistentMsg("1").Build())
+	closeWAL(t, q)
+
+	segments := walSegments(t, dir)
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Simulates crash in the middle of writing the last record
+	if err := os.Truncate(segments[0], info.Size()-3); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	q = openWAL(t, dir)
+	q.Add(persistentMsg("2").Build())
+	closeWAL(t, q)
+
+	q = openWAL(t, dir)
+	defer closeWAL(t, q)
+
+	expectKeys(t, q, "0", "2")
+}
+
+func TestWALHandler_RejectsCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir, SegmentSize(1))
+
+	for i := 0; i < 3; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+	closeWAL(t, q)
+
+	segments := walSegments(t, dir)
+	data, err := ioutil.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(segments[0], data, 0644); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if _, err := NewWALHandler(dir); err != ErrCorruptLog {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestWALHandler_CompactsConsumedSegments(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir, SegmentSize(512), SyncEvery(0))
+
+	for i := 0; i < 100; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+
+	// Messages are consumed, except for the first one which is requeued
+	tag := q.Tag()
+	first := q.Peek()
+	q.Remove()
+	q.Add(first)
+	q.Settle(tag)
+	for i := 1; i < 100; i++ {
+		settleFront(q)
+	}
+
+	for i := 100; i < 150; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+
+	if n := len(walSegments(t, dir)); n > 30 {
+		t.Errorf("Unexpected number of segments %d", n)
+	}
+	closeWAL(t, q)
+
+	q = openWAL(t, dir, SegmentSize(512))
+	defer closeWAL(t, q)
+
+	keys := []string{"0"}
+	for i := 100; i < 150; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	expectKeys(t, q, keys...)
+}
+
+func TestWALHandler_RewritesMostlyConsumedSegments(t *testing.T) {
+	dir := t.TempDir()
+	q := openWAL(t, dir)
+
+	for i := 0; i < 10; i++ {
+		q.Add(persistentMsg(strconv.Itoa(i)).Build())
+	}
+	for i := 0; i < 8; i++ {
+		settleFront(q)
+	}
+	closeWAL(t, q)
+
+	// Full segment is sealed on open, messages left in it are rewritten
+	// to the new one
+	q = openWAL(t, dir, SegmentSize(1))
+	closeWAL(t, q)
+
+	if n := len(walSegments(t, dir)); n != 1 {
+		t.Errorf("Unexpected number of segments %d", n)
+	}
+
+	q = openWAL(t, dir)
+	defer closeWAL(t, q)
+
+	expectKeys(t, q, "8", "9")
+}
+
+func openWAL(t *testing.T, dir string, opts ...WALOption) *WALHandler {
+	q, err := NewWALHandler(dir, opts...)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	return q
+}
+
+func closeWAL(t *testing.T, q *WALHandler) {
+	if err := q.Close(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+// settleFront consumes message at the front of queue, like Queue does
+// with acknowledged delivery.
+func settleFront(q amq.DurableQueueHandler) {
+	tag := q.Tag()
+	q.Remove()
+	q.Settle(tag)
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	return segments
+}
+
+func expectKeys(t *testing.T, q amq.QueueHandler, keys ...string) {
+	if q.Len() != len(keys) {
+		t.Fatalf("Unexpected queue length, expected %d got %d", len(keys), q.Len())
+	}
+
+	for _, key := range keys {
+		if msg := q.Peek(); msg.RoutingKey() != key {
+			t.Errorf("Invalid message, expected %s got %s", key, msg.RoutingKey())
+		}
+		q.Remove()
+	}
+}
+
+func persistentMsg(key string) *amq.MessageBuilder {
+	return amq.NewMessageBuilder().
+		RoutingKey(key).
+		Header("attempt", 1).
+		Body([]byte(key)).
+		DeliveryMode(amq.Persistent)
+}
+
+// walTestMsg is a persistent message with expiration deadline, like
+// messages held by Queue with TTL
+type walTestMsg struct {
+	*amq.BasicMessage
+	expiresAt time.Time
+}
+
+func (self walTestMsg) ExpiresAt() time.Time {
+	return self.expiresAt
+}